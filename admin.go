@@ -0,0 +1,131 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	prepareCalls     []func() error
+	prepareCallsLock sync.Mutex
+
+	// prepared reports whether the PrepareRestart callbacks have been run
+	// successfully since the last restart.
+	prepared bool
+
+	prepareLock sync.Mutex
+)
+
+// PrepareRestart caches callbacks, they will be run by the admin command "prepare",
+// before the actual restart. most of time, we can checkpoint state or flush caches
+// here, so the expensive work is decoupled from the restart. if any callback
+// returns an error, the process is not prepared.
+func PrepareRestart(callback func() error) {
+
+	prepareCallsLock.Lock()
+	defer prepareCallsLock.Unlock()
+
+	prepareCalls = append(prepareCalls, callback)
+}
+
+func prepare() error {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+
+	prepareCallsLock.Lock()
+	calls := append([]func() error{}, prepareCalls...)
+	prepareCallsLock.Unlock()
+
+	prepared = false
+	for _, c := range calls {
+
+		if err := c(); err != nil {
+			return err
+		}
+	}
+	prepared = true
+	return nil
+}
+
+func isPrepared() bool {
+	prepareLock.Lock()
+	defer prepareLock.Unlock()
+
+	return prepared
+}
+
+// ServeAdmin listens on the given type network and address, and handles the admin
+// commands, one command per line:
+//
+//	prepare  runs the PrepareRestart callbacks, replies "ready" or "error: ..."
+//	restart  prepares the process if not prepared yet, replies "restarting"
+//	         and restarts the process
+//	stop     replies "stopping" and stops the process
+//
+// the admin listener is a graceful listener, so the child process inherits it. use
+// a loopback or unix socket address, the commands are not authenticated. e.g.:
+//
+//	go grace.ServeAdmin("tcp", "127.0.0.1:9999")
+//
+// an orchestration tool sends "prepare" first, and "restart" after the process
+// replied "ready".
+//
+// ServeAdmin always returns a non-nil error.
+func ServeAdmin(network, addr string) error {
+
+	return ListenNetAndServe(network, addr, serveAdminConn)
+}
+
+func serveAdminConn(c net.Conn) {
+
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+
+		switch cmd := strings.TrimSpace(scanner.Text()); cmd {
+		case "prepare":
+			if err := prepare(); err != nil {
+				fmt.Fprintf(c, "error: %v\n", err)
+			} else {
+				fmt.Fprintln(c, "ready")
+			}
+		case "restart":
+			if !isPrepared() {
+				if err := prepare(); err != nil {
+					fmt.Fprintf(c, "error: %v\n", err)
+					continue
+				}
+			}
+			fmt.Fprintln(c, "restarting")
+
+			// the process waits for all connects closed, including this
+			// one, so return to close it.
+			go func() {
+				setExitReason("admin")
+				if err := Restart(); err != nil {
+					logf("admin restart failed! %v\n", err)
+				}
+
+				// Restart only returns if the restart failed.
+				prepareLock.Lock()
+				prepared = false
+				prepareLock.Unlock()
+			}()
+			return
+		case "stop":
+			fmt.Fprintln(c, "stopping")
+			setExitReason("admin")
+			go Stop()
+			return
+		case "":
+		default:
+			fmt.Fprintf(c, "error: unknown command %q\n", cmd)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"runtime"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	// arguments of the child process, nil means the same as the current process.
+	restartArgs []string
+
+	// flags override the arguments of the child process, in order.
+	restartFlags [][2]string
+
+	// extra env vars of the child process.
+	restartEnv map[string]string
+
+	argsLock sync.Mutex
+
+	execPathResolver = defaultExecPath
+
+	// absolute path of os.Args[0], resolved before the application changes the
+	// working directory.
+	argPath, argPathErr = absArgPath(os.Args[0])
+)
+
+// SetExecPathResolver sets how the executable file of the child process is
+// determined, different deploy ways(symlinked current release, versioned
+// directory, PATH lookup...) need different executable files. the default is
+// os.Executable, or the absolute path of os.Args[0] when WatchDirectory is
+// enabled, so a swapped symlink leads to the new executable file. e.g.:
+//
+//	grace.SetExecPathResolver(func() (string, error) {
+//		return "/srv/app/current/app", nil
+//	})
+func SetExecPathResolver(resolve func() (string, error)) {
+	argsLock.Lock()
+	defer argsLock.Unlock()
+
+	execPathResolver = resolve
+}
+
+func defaultExecPath() (string, error) {
+
+	// keep the symlinks on the path, os.Executable resolves them on some
+	// platforms.
+	if watchDir {
+		return argPath, argPathErr
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return argPath, argPathErr
+	}
+	return path, nil
+}
+
+// absArgPath returns the absolute path of the program name, a name without any
+// path separator was found in $PATH.
+func absArgPath(name string) (string, error) {
+
+	if !strings.ContainsRune(name, filepath.Separator) && !strings.ContainsRune(name, '/') {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", err
+		}
+		name = path
+	}
+	return filepath.Abs(name)
+}
+
+// execPath returns the executable file of the child process.
+func execPath() (string, error) {
+	argsLock.Lock()
+	resolve := execPathResolver
+	argsLock.Unlock()
+
+	return resolve()
+}
+
+// RestartWith acts like Restart, but the new process is started from the executable
+// file "path", e.g. a new binary built to a versioned path("app-v2"), it inherits
+// the same sockets and arguments. the file is checked for executable before the
+// drain. the following restarts use the current executable file again if it
+// failed, the new process decides its own executable file.
+func RestartWith(path string) error {
+
+	return defaultManager.RestartWith(path)
+}
+
+// RestartWith acts like the package function RestartWith.
+func (m *Manager) RestartWith(path string) error {
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode()&0111 == 0) {
+		return errors.New("grace: " + path + " is not executable")
+	}
+
+	// only returns if the restart failed.
+	return m.restart(restartOptions{path: path})
+}
+
+// SetRestartArgs sets the arguments(without the program name) of the child
+// process, by default the child process gets the same arguments as the current
+// process. nil restores the default, an empty slice starts the child process
+// without any argument.
+func SetRestartArgs(args []string) {
+
+	argsLock.Lock()
+	defer argsLock.Unlock()
+
+	if args == nil {
+		restartArgs = nil
+		return
+	}
+	restartArgs = append([]string{}, args...)
+}
+
+// SetRestartFlag overrides the flag "name" in the arguments of the child process
+// with "value", both "-name value" and "-name=value" forms are replaced.
+func SetRestartFlag(name, value string) {
+	argsLock.Lock()
+	defer argsLock.Unlock()
+
+	restartFlags = setFlag(restartFlags, name, value)
+}
+
+// setFlag sets the flag "name" to "value", the flag keeps its position if it's
+// already in "flags".
+func setFlag(flags [][2]string, name, value string) [][2]string {
+
+	for i, f := range flags {
+		if f[0] == name {
+			flags[i][1] = value
+			return flags
+		}
+	}
+	return append(flags, [2]string{name, value})
+}
+
+// restartOptions changes the child process of a single restart, the following
+// restarts are not affected, e.g. a failed RestartWithConfig leaves nothing behind.
+type restartOptions struct {
+
+	// flags override the arguments of the child process, after the ones set by
+	// SetRestartFlag.
+	flags [][2]string
+
+	// executable file of the child process, empty means execPath.
+	path string
+}
+
+// SetRestartEnv sets extra env vars of the child process, e.g. a "warm start"
+// marker or a shared memory key, they override the env vars of the current process.
+// the child process always gets "GRACE_RESTART_COUNT", the number of restarts since
+// the cold start, so it can tell a restart from a cold start:
+//
+//	if os.Getenv("GRACE_RESTART_COUNT") != "" {
+//		// started by a restart
+//	}
+//
+// nil removes the extra env vars.
+func SetRestartEnv(env map[string]string) {
+	argsLock.Lock()
+	defer argsLock.Unlock()
+
+	restartEnv = make(map[string]string, len(env))
+	for k, v := range env {
+		restartEnv[k] = v
+	}
+}
+
+// restartEnvVars returns the extra env vars of the child process in "key=value"
+// form, sorted by key.
+func restartEnvVars() []string {
+	argsLock.Lock()
+	defer argsLock.Unlock()
+
+	vars := make([]string, 0, len(restartEnv))
+	for k, v := range restartEnv {
+		vars = append(vars, k+"="+v)
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+// RestartWithConfig restarts the process into a new config file, the child
+// process gets the flag "flagName" with the value "path", while the current
+// process keeps the old config until it exited. e.g.:
+//
+//	var config = flag.String("config", "config.yml", "config file")
+//
+//	...
+//
+//	err := grace.RestartWithConfig("config", "config-v2.yml")
+//
+// the config file is checked for readable before restarting, so a missing file
+// won't cause a failed cutover. the flag only overrides the arguments of this
+// restart, the following restarts use the old arguments again if it failed, while
+// the child process keeps the flag in its own arguments. RestartWithConfig only
+// returns if the restart failed.
+func RestartWithConfig(flagName, path string) error {
+
+	return defaultManager.RestartWithConfig(flagName, path)
+}
+
+// RestartWithConfig acts like the package function RestartWithConfig.
+func (m *Manager) RestartWithConfig(flagName, path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	return m.restart(restartOptions{flags: [][2]string{{flagName, path}}})
+}
+
+// the arguments of the current process without the program name, captured at
+// startup, see userArgs.
+var initialArgs []string
+
+// userArgs returns the arguments of the current process without the program name,
+// as they were at startup, so the child process gets the exact arguments of the
+// cold start however many restarts deep it is, even if the application rewrote
+// os.Args. the child process is marked by the environment, not by an argument.
+func userArgs() []string {
+
+	return append([]string{}, initialArgs...)
+}
+
+// childArgs returns the arguments of the child process.
+func childArgs(opts restartOptions) []string {
+	argsLock.Lock()
+	defer argsLock.Unlock()
+
+	args := restartArgs
+	if args == nil {
+		args = userArgs()
+	}
+
+	overrides := append([][2]string{}, restartFlags...)
+	for _, f := range opts.flags {
+		overrides = setFlag(overrides, f[0], f[1])
+	}
+
+	// flags must be placed before the first non-flag argument.
+	var flags []string
+	for _, f := range overrides {
+		args = removeFlag(args, f[0])
+		flags = append(flags, "-"+f[0]+"="+f[1])
+	}
+
+	return append(flags, args...)
+}
+
+// removeFlag removes the flag "name" and its value from the arguments.
+func removeFlag(args []string, name string) []string {
+
+	var result []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// flags terminator.
+		if arg == "--" {
+			return append(result, args[i:]...)
+		}
+
+		n := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if n == arg {
+			result = append(result, arg)
+			continue
+		}
+
+		if n == name {
+
+			// skip the value of "-name value".
+			if takesValue(name, args[i+1:]) {
+				i++
+			}
+			continue
+		}
+
+		if strings.HasPrefix(n, name+"=") {
+			continue
+		}
+		result = append(result, arg)
+	}
+	return result
+}
+
+// takesValue reports whether the flag "name" without "=" is followed by its value,
+// a boolean flag never is, so the next argument is kept. the flags not registered
+// with package flag are guessed: the next argument is the value unless it's a flag.
+func takesValue(name string, next []string) bool {
+
+	if f := flag.Lookup(name); f != nil {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		return !ok || !b.IsBoolFlag()
+	}
+	return len(next) > 0 && !strings.HasPrefix(next[0], "-")
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"flag"
+	"errors"
+	"reflect"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
+)
+
+var _ = flag.Bool("grace-test-bool", false, "a boolean flag of the tests")
+
+func TestRemoveFlag(t *testing.T) {
+
+	tests := []struct {
+		args []string
+		name string
+		want []string
+	}{
+		{[]string{"-config", "a.yml", "run"}, "config", []string{"run"}},
+		{[]string{"--config=a.yml", "run"}, "config", []string{"run"}},
+		{[]string{"-v", "-config", "a.yml"}, "config", []string{"-v"}},
+
+		// a boolean flag has no separate value, the positional argument stays.
+		{[]string{"-grace-test-bool", "run"}, "grace-test-bool", []string{"run"}},
+		{[]string{"-grace-test-bool=true", "run"}, "grace-test-bool", []string{"run"}},
+
+		// an unknown flag followed by another flag has no value.
+		{[]string{"-unknown", "-v"}, "unknown", []string{"-v"}},
+		{[]string{"-config", "a.yml", "--", "-config"}, "config", []string{"--", "-config"}},
+	}
+
+	for _, test := range tests {
+		if got := removeFlag(test.args, test.name); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("removeFlag(%q, %q) = %q, want %q", test.args, test.name, got, test.want)
+		}
+	}
+}
+
+func TestRestartWithConfigFailed(t *testing.T) {
+
+	config := filepath.Join(t.TempDir(), "config-v2.yml")
+	if err := ioutil.WriteFile(config, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	errStart := errors.New("start failed")
+	testhook.SetStart(func() (*os.Process, error) {
+		return nil, errStart
+	})
+	t.Cleanup(func() {
+		testhook.SetStart(nil)
+		resetRestartState()
+	})
+
+	m := newTestManager(t)
+	if err := m.RestartWithConfig("config", config); err != errStart {
+		t.Fatalf("RestartWithConfig() = %v, want %v", err, errStart)
+	}
+
+	// the override is gone with the failed restart.
+	for _, arg := range childArgs(restartOptions{}) {
+		if arg == "-config="+config {
+			t.Fatalf("the next restart still gets %s", arg)
+		}
+	}
+}
+
+func TestRestartWithConfig(t *testing.T) {
+
+	config := filepath.Join(t.TempDir(), "config-v2.yml")
+	if err := ioutil.WriteFile(config, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newTestManager(t).RestartWithConfig("config", filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Fatal("restarted into a missing config file")
+	}
+
+	report := realRestart(t)
+	if err := newTestManager(t).RestartWithConfig("config", config); err != nil {
+		t.Fatal(err)
+	}
+
+	child := readReport(t, report, 1)
+	if len(child.Args) == 0 || child.Args[0] != "-config="+config {
+		t.Fatalf("child process arguments: %q", child.Args)
+	}
+}
+
+func TestRestartWith(t *testing.T) {
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := filepath.Join(t.TempDir(), "app-v2")
+	copyExecutable(t, exe, next, nil)
+
+	report := realRestart(t)
+	if err := newTestManager(t).RestartWith(next); err != nil {
+		t.Fatal(err)
+	}
+
+	child := readReport(t, report, 1)
+	if want, _ := filepath.EvalSymlinks(next); child.Executable != want {
+		t.Fatalf("child process executable %s, want %s", child.Executable, want)
+	}
+
+	// the path belongs to that restart only.
+	if path, _ := execPath(); path == next {
+		t.Fatalf("the next restart still starts %s", path)
+	}
+}
+
+func TestRestartKeepsArgs(t *testing.T) {
+
+	args := []string{"--port", "9000", "--verbose"}
+	saved := initialArgs
+	initialArgs = args
+	defer func() {
+		initialArgs = saved
+	}()
+
+	// the first child process restarts once more.
+	report := realRestarts(t, 2)
+	if err := newTestManager(t).Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	for gen := 1; gen <= 2; gen++ {
+		if child := readReport(t, report, gen); !reflect.DeepEqual(child.Args, args) {
+			t.Fatalf("arguments of generation %d: %q, want %q", gen, child.Args, args)
+		}
+	}
+}
+
+func TestSetRestartArgsNil(t *testing.T) {
+
+	saved := initialArgs
+	initialArgs = []string{"-v", "run"}
+	defer func() {
+		initialArgs = saved
+		SetRestartArgs(nil)
+	}()
+
+	SetRestartArgs([]string{})
+	if got := childArgs(restartOptions{}); len(got) != 0 {
+		t.Fatalf("child process arguments %q, want none", got)
+	}
+
+	// back to the arguments of the current process.
+	SetRestartArgs(nil)
+	if got := childArgs(restartOptions{}); !reflect.DeepEqual(got, initialArgs) {
+		t.Fatalf("child process arguments %q, want %q", got, initialArgs)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"sync"
+	"context"
+	"sync/atomic"
+)
+
+var (
+	// opened connects accepted by the graceful listeners.
+	conns = make(map[*netConn]struct{})
+
+	connsLock sync.Mutex
+
+	// number of the connects dropped during the drain.
+	droppedConns int64
+)
+
+// DroppedConns returns the number of the connects which were accepted, but closed
+// during the drain(e.g. a restart) before any data transferred. a truly zero-downtime
+// restart drops nothing, so it's a metric worth alerting on.
+func DroppedConns() int64 {
+
+	return atomic.LoadInt64(&droppedConns)
+}
+
+func trackConn(n *netConn) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	conns[n] = struct{}{}
+}
+
+func untrackConn(n *netConn) {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	delete(conns, n)
+}
+
+// lookupConn returns the graceful connect wrapped by "c", e.g. by a *tls.Conn,
+// returns nil if "c" is not accepted by a graceful listener.
+func lookupConn(c net.Conn) *netConn {
+
+	for {
+		switch v := c.(type) {
+		case *netConn:
+			return v
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// connKey is the context key of the graceful connect serving a request.
+type connKey struct{}
+
+// withConn returns a context carrying the graceful connect wrapped by "c", e.g.
+// the context of its requests, see ReloadInPlaceCtx.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+
+	if n := lookupConn(c); n != nil {
+		return context.WithValue(ctx, connKey{}, n)
+	}
+	return ctx
+}
+
+// connFromContext returns the graceful connect carried by "ctx", or nil.
+func connFromContext(ctx context.Context) *netConn {
+
+	n, _ := ctx.Value(connKey{}).(*netConn)
+	return n
+}
+
+// ConnectionsByAddr returns the number of the opened connects per listener address,
+// e.g. to watch the drain progress of every port when the process serves more than
+// one listener. the addresses without any opened connect are omitted.
+func ConnectionsByAddr() map[string]int {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	counts := make(map[string]int)
+	for n := range conns {
+		counts[n.addr]++
+	}
+	return counts
+}
+
+// TagConn tags the connect with "tag", e.g. the shard key of a sharded server,
+// so the connects can be drained by tag, see DrainShard. it returns false if "c"
+// is not accepted by a graceful listener.
+func TagConn(c net.Conn, tag string) bool {
+
+	n := lookupConn(c)
+	if n == nil {
+		return false
+	}
+
+	connsLock.Lock()
+	n.tag = tag
+	connsLock.Unlock()
+	return true
+}
+
+// TrackConn registers a long-lived connect, e.g. a WebSocket hijacked from a
+// graceful http server, which http.Server.Shutdown doesn't wait for, "onDrain" is
+// called in its own goroutine when the drain begins, so the connect can say goodbye
+// (e.g. a close frame) and close by itself. the process waits for the connect like
+// the others, StopWithTimeout closes it after the timeout. see package gracews for
+// the WebSockets. it returns false if "c" is not accepted by a graceful listener.
+func TrackConn(c net.Conn, onDrain func()) bool {
+
+	n := lookupConn(c)
+	if n == nil {
+		return false
+	}
+
+	connsLock.Lock()
+	n.onDrain = onDrain
+	connsLock.Unlock()
+	return true
+}
+
+// notifyDrainConns calls the drain callbacks of the connects of the manager, see
+// TrackConn.
+func notifyDrainConns(m *Manager) {
+
+	connsLock.Lock()
+	var callbacks []func()
+	for n := range conns {
+		if n.m == m && n.onDrain != nil {
+			callbacks = append(callbacks, n.onDrain)
+		}
+	}
+	connsLock.Unlock()
+
+	for _, callback := range callbacks {
+		go callback()
+	}
+}
+
+// DrainShard closes the opened connects tagged with "key"(see TagConn), the
+// listeners and the other connects are not affected, so a shard can be migrated
+// to another node without restarting. it returns the number of closed connects.
+func DrainShard(key string) int {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	var count int
+	for n := range conns {
+		if n.tag == key {
+
+			// only close the underlying connect, the handler will get an
+			// error and close the netConn.
+			n.Conn.Close()
+			count++
+		}
+	}
+
+	logf("drained %d connects of shard %q\n", count, key)
+	return count
+}
+
+// closeConns closes all tracked connects of the manager, it returns the number
+// of them.
+func closeConns(m *Manager) int {
+
+	connsLock.Lock()
+	var opened []*netConn
+	for n := range conns {
+		if n.m == m {
+			opened = append(opened, n)
+		}
+	}
+	connsLock.Unlock()
+
+	for _, n := range opened {
+		n.Close()
+	}
+	return len(opened)
+}
+
+// onDrainIdleConn handles the idle connects during the drain, see OnDrainIdleConn.
+var onDrainIdleConn func(net.Conn) bool
+
+// OnDrainIdleConn sets a callback which will be called with every idle connect when
+// the drain begins(after the listeners closed), returning true means the application
+// takes the ownership of the connect, the process stops tracking it and won't wait
+// for it, returning false means the connect will be closed. e.g. a connection pooling
+// proxy can hand the idle pooled connects to a quiesce routine instead of closing
+// them.
+//
+// the connects are marked idle by SetConnIdle, the connects of the graceful http
+// servers are marked automatically, but note that the http server keeps serving the
+// connect it doesn't know was taken, so most of time the http connects should be
+// closed.
+func OnDrainIdleConn(callback func(net.Conn) bool) {
+
+	onDrainIdleConn = callback
+}
+
+// SetConnIdle marks the connect accepted by a graceful listener as idle or not, it
+// returns false if "c" is not a graceful connect. see OnDrainIdleConn.
+func SetConnIdle(c net.Conn, idle bool) bool {
+
+	n := lookupConn(c)
+	if n == nil {
+		return false
+	}
+
+	var v int32
+	if idle {
+		v = 1
+	}
+	atomic.StoreInt32(&n.idle, v)
+	return true
+}
+
+// drainIdleConns passes the idle connects of the manager to the OnDrainIdleConn
+// callback.
+func drainIdleConns(m *Manager) {
+
+	callback := onDrainIdleConn
+	if callback == nil {
+		return
+	}
+
+	connsLock.Lock()
+	var idles []*netConn
+	for n := range conns {
+		if n.m == m && atomic.LoadInt32(&n.idle) == 1 {
+			idles = append(idles, n)
+		}
+	}
+	connsLock.Unlock()
+
+	for _, n := range idles {
+
+		if callback(n) {
+			n.release()
+		} else {
+			n.Close()
+		}
+	}
+}
+
+// DrainStats breaks down the opened connects.
+type DrainStats struct {
+
+	// http connects which are handling requests.
+	ActiveRequests int `json:"active_requests"`
+
+	// http connects which are waiting for the next request.
+	IdleKeepAlive int `json:"idle_keep_alive"`
+
+	// connects which are not served by the graceful http servers.
+	RawConnections int `json:"raw_connections"`
+}
+
+// DrainBreakdown returns the numbers of the opened connects by kind. when a drain
+// is slow, it tells whether the drain is blocked by active requests(wait for them)
+// or by idle keep-alive connects(which should have been closed).
+func DrainBreakdown() DrainStats {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	var stats DrainStats
+	for n := range conns {
+		switch {
+		case atomic.LoadInt32(&n.http) == 0:
+			stats.RawConnections++
+		case atomic.LoadInt32(&n.idle) == 1:
+			stats.IdleKeepAlive++
+		default:
+			stats.ActiveRequests++
+		}
+	}
+	return stats
+}
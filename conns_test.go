@@ -0,0 +1,42 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnectionsByAddr(t *testing.T) {
+
+	m := newTestManager(t)
+	var ls []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := m.NewListener("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ls = append(ls, l)
+	}
+	a, b := ls[0].Addr().String(), ls[1].Addr().String()
+
+	a1, _ := acceptOne(t, ls[0])
+	a2, _ := acceptOne(t, ls[0])
+	b1, _ := acceptOne(t, ls[1])
+	defer a2.Close()
+	defer b1.Close()
+
+	counts := ConnectionsByAddr()
+	if counts[a] != 2 || counts[b] != 1 {
+		t.Fatalf("connects %v, want 2 on %s and 1 on %s", counts, a, b)
+	}
+
+	// closing a connect only changes the count of its listener.
+	a1.Close()
+	counts = ConnectionsByAddr()
+	if counts[a] != 1 || counts[b] != 1 {
+		t.Fatalf("connects %v, want 1 on %s and 1 on %s", counts, a, b)
+	}
+}
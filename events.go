@@ -0,0 +1,132 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Phase is a step of the restart or the stop.
+type Phase int
+
+const (
+
+	// PhaseChildStarted means the new process was started by Restart.
+	PhaseChildStarted Phase = iota
+
+	// PhaseDraining means the listeners stopped accepting new connects, it's sent
+	// before the BeforeCloseCall callbacks.
+	PhaseDraining
+
+	// PhaseListenersClosed means the listeners were closed.
+	PhaseListenersClosed
+
+	// PhaseDrained means the opened connects were all closed, or the drain timed
+	// out.
+	PhaseDrained
+
+	// PhaseExiting means the process is about to exit.
+	PhaseExiting
+)
+
+func (p Phase) String() string {
+
+	switch p {
+	case PhaseChildStarted:
+		return "child started"
+	case PhaseDraining:
+		return "draining"
+	case PhaseListenersClosed:
+		return "listeners closed"
+	case PhaseDrained:
+		return "drained"
+	case PhaseExiting:
+		return "exiting"
+	}
+	return "unknown"
+}
+
+// Event is sent through the Events channel.
+type Event struct {
+	Phase Phase
+	Time  time.Time
+
+	// why the process is closing.
+	Reason Reason
+
+	// pid of the new process, only for PhaseChildStarted.
+	ChildPID int
+
+	// number of the opened connects of all managers.
+	ActiveConns int64
+}
+
+// eventsBuffer is the capacity of the events channel.
+const eventsBuffer = 64
+
+var (
+	events = make(chan Event, eventsBuffer)
+
+	// callbacks of ObserveEvents.
+	observers     []func(Event)
+	observersLock sync.Mutex
+)
+
+// Events returns the channel of the lifecycle events, e.g. to update a readiness
+// probe when the process starts draining:
+//
+//	go func() {
+//		for e := range grace.Events() {
+//			if e.Phase == grace.PhaseDraining {
+//				ready.Store(false)
+//			}
+//		}
+//	}()
+//
+// the events of all the managers are sent to the same channel. the channel is
+// buffered and never blocks the restart or the stop, the events are dropped if
+// the consumer is too slow. the channel is never closed.
+func Events() <-chan Event {
+
+	return events
+}
+
+// ObserveEvents registers a callback which is called with every lifecycle event
+// synchronously, in the goroutine of the restart or the stop, e.g. for tracing, see
+// package graceotel. unlike Events, every observer gets all the events, the callback
+// must return quickly.
+func ObserveEvents(callback func(Event)) {
+	observersLock.Lock()
+	defer observersLock.Unlock()
+
+	observers = append(observers, callback)
+}
+
+// emit sends the event without blocking.
+func emit(phase Phase, childPID int) {
+
+	e := Event{
+		Phase:       phase,
+		Time:        time.Now(),
+		Reason:      closeReason(),
+		ChildPID:    childPID,
+		ActiveConns: atomic.LoadInt64(&activeConns),
+	}
+
+	observersLock.Lock()
+	callbacks := append([]func(Event){}, observers...)
+	observersLock.Unlock()
+	for _, c := range callbacks {
+		c(e)
+	}
+
+	select {
+	case events <- e:
+	default:
+		logf("event dropped: %s\n", phase)
+	}
+}
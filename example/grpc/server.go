@@ -0,0 +1,39 @@
+// +build ignore
+
+package main
+
+import (
+	"gopkg.in/orivil/grace.v1"
+	"gopkg.in/orivil/grace.v1/gracegrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"log"
+	"time"
+)
+
+// try: grpc_health_probe -addr=127.0.0.1:50051
+// then restart: kill -HUP $pid
+func main() {
+
+	grace.ListenSignal()
+
+	l, err := gracegrpc.Listen("tcp", ":50051")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+
+	// finish the pending RPCs within 30 seconds on restart or stop.
+	gracegrpc.GracefulStop(server, 30*time.Second)
+
+	if err := server.Serve(l); err != nil {
+		log.Println(err)
+	}
+
+	// Serve returns as soon as the drain began, the process exits after the
+	// pending RPCs finished.
+	select {}
+}
@@ -10,6 +10,7 @@ import (
 	"gopkg.in/orivil/log.v0"
 	"sync"
 	"os"
+	"context"
 )
 
 var (
@@ -65,7 +66,7 @@ func main() {
 	grace.ListenSignal()
 
 	addr := ":8081"
-	err := grace.ListenNetAndServe("tcp", addr, func(c net.Conn) {
+	err := grace.ListenNetAndServeCtx("tcp", addr, func(ctx context.Context, c net.Conn) {
 
 		var user User
 		var name = make([]byte, 256)
@@ -95,6 +96,15 @@ func main() {
 
 		broadRoom()
 
+		// notify the user before the server closes the socket.
+		go func() {
+			<-ctx.Done()
+			if grace.IsDraining() {
+				io.WriteString(c, sprintf("server is restarting, please reconnect.\n"))
+				c.Close()
+			}
+		}()
+
 		for {
 			data := make([]byte, 1024)
 			n, err := c.Read(data)
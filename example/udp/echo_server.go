@@ -0,0 +1,29 @@
+// +build ignore
+
+package main
+
+import (
+	"gopkg.in/orivil/grace.v1"
+	"log"
+)
+
+// try: echo hello | nc -u -w1 127.0.0.1 8053
+func main() {
+
+	grace.ListenSignal()
+
+	c, err := grace.NewPacketConn("udp", ":8053")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		c.WriteTo(buf[:n], addr)
+	}
+}
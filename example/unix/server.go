@@ -0,0 +1,31 @@
+// +build ignore
+
+package main
+
+import (
+	"gopkg.in/orivil/grace.v1"
+	"net/http"
+	"io"
+	"log"
+)
+
+// try: curl --unix-socket /tmp/grace.sock http://localhost/
+func main() {
+
+	grace.ListenSignal()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+
+		io.WriteString(w, "hello world!\n")
+	})
+
+	// the socket file is kept across restarts, and removed on the final stop.
+	l, err := grace.NewListener("unix", "/tmp/grace.sock")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := &grace.Server{Server: &http.Server{}}
+	err = server.Serve(l)
+	log.Fatal(err)
+}
@@ -0,0 +1,45 @@
+// +build ignore
+
+package main
+
+import (
+	"gopkg.in/orivil/grace.v1"
+	"gopkg.in/orivil/grace.v1/gracews"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"log"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// try: websocat ws://127.0.0.1:8080/echo
+// then restart: kill -HUP $pid, the client gets a close frame "going away".
+func main() {
+
+	grace.ListenSignal()
+
+	http.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		gracews.Track(ws)
+
+		for {
+			t, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(t, msg); err != nil {
+				return
+			}
+		}
+	})
+
+	err := grace.ListenAndServe(":8080", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"expvar"
+	"sync"
+)
+
+var publishOnce sync.Once
+
+// PublishExpvar publishes the live counters through package expvar under the name
+// "grace", e.g. watch the connects drain to zero by "/debug/vars" during a deploy:
+//
+//	"grace": {
+//		"active_connections": 3,
+//		"total_connections": 1024,
+//		"listeners": 2,
+//		"restarts": 5,
+//		"draining": true
+//	}
+//
+// "listeners" and "draining" are of the default manager, "restarts" is the number
+// of restarts since the cold start. nothing is published unless it's called,
+// calling it more than once has no effect.
+func PublishExpvar() {
+
+	publishOnce.Do(func() {
+		expvar.Publish("grace", expvar.Func(func() interface{} {
+
+			_, _, listeners := defaultManager.closeCalls()
+			return map[string]interface{}{
+				"active_connections": ActiveConns(),
+				"total_connections":  TotalConns(),
+				"listeners":          len(listeners),
+				"restarts":           generation,
+				"draining":           IsDraining(),
+			}
+		}))
+	})
+}
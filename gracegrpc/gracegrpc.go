@@ -0,0 +1,94 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gracegrpc ties the shutdown of a gRPC server into the drain of package
+// grace. the listener of the server is created by Listen, so it's inherited on
+// restart like any other listener, e.g.:
+//
+//	l, err := gracegrpc.Listen("tcp", ":50051")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	server := grpc.NewServer()
+//	...
+//	gracegrpc.GracefulStop(server, 30*time.Second)
+//
+//	grace.ListenSignal()
+//	server.Serve(l)
+//
+//	// Serve returns nil or grace.ErrServerClosed as soon as the drain began,
+//	// don't exit before the process exits by itself.
+//	select {}
+package gracegrpc
+
+import (
+	"net"
+	"context"
+	"time"
+	"gopkg.in/orivil/grace.v1"
+	"google.golang.org/grpc"
+)
+
+// Listen creates a graceful listener for a gRPC server, see grace.NewListener.
+// GracefulStop waits for the accept loop of Serve, so Accept returns as soon as
+// the drain began, see grace.ReturnOnDrain. a listener of grace.NewListener would
+// block GracefulStop forever.
+func Listen(network, addr string) (net.Listener, error) {
+
+	return ListenManager(grace.DefaultManager(), network, addr)
+}
+
+// ListenManager acts like Listen, the listener belongs to the manager.
+func ListenManager(m *grace.Manager, network, addr string) (net.Listener, error) {
+
+	l, err := m.NewListener(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	grace.ReturnOnDrain(l)
+	return l, nil
+}
+
+// GracefulStop stops "server" by GracefulStop when the drain begins, the server
+// stops accepting new RPCs and the pending RPCs finish, after "timeout" the server
+// is stopped by Stop, which cancels the remaining RPCs. 0 means the drain deadline
+// of StopWithTimeout, or no timeout if the drain has no deadline. the process
+// waits for the connections of the server like the other connects. the server
+// must serve the listeners of Listen.
+func GracefulStop(server *grpc.Server, timeout time.Duration) {
+
+	GracefulStopManager(grace.DefaultManager(), server, timeout)
+}
+
+// GracefulStopManager acts like GracefulStop, the server is stopped by the drain
+// of the manager.
+func GracefulStopManager(m *grace.Manager, server *grpc.Server, timeout time.Duration) {
+
+	m.BeforeCloseCallCtx(func(ctx context.Context, reason grace.Reason) {
+
+		var expired <-chan time.Time
+		if timeout > 0 {
+			expired = time.After(timeout)
+		} else if deadline, ok := ctx.Deadline(); ok {
+			expired = time.After(time.Until(deadline))
+		}
+
+		// GracefulStop blocks until the pending RPCs finished, don't hold the
+		// other callbacks.
+		done := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(done)
+		}()
+
+		go func() {
+			select {
+			case <-done:
+			case <-expired:
+				server.Stop()
+			}
+		}()
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package gracegrpc
+
+import (
+	"time"
+	"context"
+	"testing"
+	"gopkg.in/orivil/grace.v1"
+	"gopkg.in/orivil/grace.v1/gracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// serve starts a gRPC server stopped by the drain of "m", and returns a client
+// connected to it and the result of Serve.
+func serve(t *testing.T, m *grace.Manager) (grpc_health_v1.HealthClient, <-chan error) {
+
+	l, err := ListenManager(m, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	GracefulStopManager(m, server, 5*time.Second)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(l)
+	}()
+
+	conn, err := grpc.NewClient("passthrough:///"+l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	client := grpc_health_v1.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	return client, served
+}
+
+// waitServe waits for Serve, which returns nil or grace.ErrServerClosed by the
+// drain.
+func waitServe(served <-chan error) error {
+
+	if err := <-served; err != grace.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// within fails the test if "f" doesn't return in time.
+func within(t *testing.T, what string, f func() error) {
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s doesn't return", what)
+	}
+}
+
+func TestGracefulStopRestart(t *testing.T) {
+
+	h := gracetest.New(t)
+	m := grace.NewManager()
+	_, served := serve(t, m)
+
+	// the drain waits for the gRPC connection, which is closed by GracefulStop.
+	within(t, "Restart", m.Restart)
+	if h.Starts() != 1 {
+		t.Fatalf("started %d times, want 1", h.Starts())
+	}
+	within(t, "Serve", func() error {
+		return waitServe(served)
+	})
+}
+
+func TestGracefulStopStop(t *testing.T) {
+
+	gracetest.New(t)
+	m := grace.NewManager()
+	_, served := serve(t, m)
+
+	within(t, "StopGraceful", m.StopGraceful)
+	within(t, "Serve", func() error {
+		return waitServe(served)
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gracemetrics exports the metrics of package grace to Prometheus:
+//
+//	grace_active_connections        opened connects
+//	grace_total_connections         connects accepted during the process lifetime
+//	grace_restarts_total{result}    restart attempts, result is "success" or "failure"
+//	grace_drain_duration_seconds    duration of the last drain
+//
+// e.g.:
+//
+//	if err := gracemetrics.Register(prometheus.DefaultRegisterer); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// the counters start from zero in every process, a restart starts a new process.
+package gracemetrics
+
+import (
+	"time"
+	"gopkg.in/orivil/grace.v1"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Register registers the collectors to "reg" and installs the metrics hooks of
+// package grace, see grace.SetMetricsHooks.
+func Register(reg prometheus.Registerer) error {
+
+	active := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "grace_active_connections",
+		Help: "Number of the opened connections.",
+	}, func() float64 {
+		return float64(grace.ActiveConns())
+	})
+
+	total := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "grace_total_connections",
+		Help: "Number of the connections accepted during the process lifetime.",
+	}, func() float64 {
+		return float64(grace.TotalConns())
+	})
+
+	restarts := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grace_restarts_total",
+		Help: "Number of the restart attempts by result.",
+	}, []string{"result"})
+
+	drain := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grace_drain_duration_seconds",
+		Help: "Duration of the last drain in seconds.",
+	})
+
+	for _, c := range []prometheus.Collector{active, total, restarts, drain} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	// report both results from the beginning.
+	restarts.WithLabelValues("success")
+	restarts.WithLabelValues("failure")
+
+	grace.SetMetricsHooks(grace.MetricsHooks{
+		Restarted: func(err error) {
+			if err != nil {
+				restarts.WithLabelValues("failure").Inc()
+			} else {
+				restarts.WithLabelValues("success").Inc()
+			}
+		},
+		Drained: func(d time.Duration) {
+			drain.Set(d.Seconds())
+		},
+	})
+	return nil
+}
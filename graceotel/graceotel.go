@@ -0,0 +1,93 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package graceotel traces the drains of package grace with OpenTelemetry, so a
+// deploy can be correlated with the request latency. a span "grace.drain" covers
+// every drain, from the listeners stopped accepting to the opened connects all
+// closed, with the events "listeners closed" and "drained", e.g.:
+//
+//	graceotel.Trace(otel.Tracer("myapp"))
+//
+// the span of a restart carries the pid of the new process.
+package graceotel
+
+import (
+	"context"
+	"sync"
+	"gopkg.in/orivil/grace.v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trace starts tracing the drains with "tracer", it should be called once.
+func Trace(tracer trace.Tracer) {
+
+	t := &tracing{tracer: tracer}
+	grace.ObserveEvents(t.observe)
+}
+
+type tracing struct {
+	tracer trace.Tracer
+
+	// span of the current drain.
+	span trace.Span
+
+	// pid of the new process started before the drain.
+	childPID int
+
+	sync.Mutex
+}
+
+func (t *tracing) observe(e grace.Event) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	conns := attribute.Int64("grace.active_connections", e.ActiveConns)
+	switch e.Phase {
+	case grace.PhaseChildStarted:
+
+		// the new process may start during the drain, after the listeners
+		// closed.
+		if t.span != nil {
+			t.span.SetAttributes(attribute.Int("grace.child_pid", e.ChildPID))
+		} else {
+			t.childPID = e.ChildPID
+		}
+	case grace.PhaseDraining:
+		t.end()
+		_, t.span = t.tracer.Start(context.Background(), "grace.drain",
+			trace.WithTimestamp(e.Time),
+			trace.WithAttributes(
+				attribute.String("grace.reason", e.Reason.String()),
+				conns,
+			),
+		)
+		if t.childPID != 0 {
+			t.span.SetAttributes(attribute.Int("grace.child_pid", t.childPID))
+			t.childPID = 0
+		}
+	case grace.PhaseListenersClosed:
+		if t.span != nil {
+			t.span.AddEvent("listeners closed", trace.WithTimestamp(e.Time), trace.WithAttributes(conns))
+		}
+	case grace.PhaseDrained:
+		if t.span != nil {
+			t.span.AddEvent("drained", trace.WithTimestamp(e.Time), trace.WithAttributes(conns))
+			t.span.End(trace.WithTimestamp(e.Time))
+			t.span = nil
+		}
+	case grace.PhaseExiting:
+		t.end()
+	}
+}
+
+// end ends the unfinished span, e.g. the drain was not waited.
+func (t *tracing) end() {
+
+	if t.span != nil {
+		t.span.End()
+		t.span = nil
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gracetest simulates the graceful restarts in-process, the new process is
+// never started and the process never exits, so the restart logic of an
+// application can be tested, e.g.:
+//
+//	func TestRestart(t *testing.T) {
+//
+//		h := gracetest.New(t)
+//
+//		m := grace.NewManager()
+//		l, _ := m.NewListener("tcp", "127.0.0.1:0")
+//
+//		var closed bool
+//		m.AfterCloseCall(func() { closed = true })
+//
+//		if err := m.Restart(); err != nil {
+//			t.Fatal(err)
+//		}
+//
+//		if h.Starts() != 1 || !closed {
+//			t.Fatal("not restarted")
+//		}
+//		if _, err := l.Accept(); err != grace.ErrServerClosed {
+//			t.Fatal("listener not closed")
+//		}
+//		// h.Phases(): child started, draining, listeners closed, drained, exiting
+//	}
+package gracetest
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"gopkg.in/orivil/grace.v1"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
+)
+
+// FakePID is the pid of the fake child processes.
+const FakePID = 1<<31 - 1
+
+// Harness replaces the start of the child process and the exit of the process,
+// and records what happened.
+type Harness struct {
+	lock sync.Mutex
+
+	starts   int
+	startErr error
+
+	exited   bool
+	exitCode int
+
+	phases []grace.Phase
+}
+
+// New installs a harness, it's uninstalled by the cleanup of "t". the harness is
+// process wide, the tests using it must not run in parallel.
+//
+// the harness consumes the channel of grace.Events, don't read the channel in
+// the tests.
+func New(t testing.TB) *Harness {
+
+	h := &Harness{}
+	h.Phases()
+	h.phases = nil
+
+	testhook.SetStart(h.start)
+	testhook.SetExit(h.exit)
+	t.Cleanup(h.Close)
+	return h
+}
+
+// Close uninstalls the harness and resets the restart state, so the next harness
+// can restart again.
+func (h *Harness) Close() {
+
+	testhook.SetStart(nil)
+	testhook.SetExit(nil)
+	if testhook.Reset != nil {
+		testhook.Reset()
+	}
+}
+
+// FailStart makes the following starts of the child process fail with "err", nil
+// makes them succeed.
+func (h *Harness) FailStart(err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.startErr = err
+}
+
+// Starts returns how many times the child process was started, including the
+// failed starts.
+func (h *Harness) Starts() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.starts
+}
+
+// Exited returns the exit code if the process would have exited.
+func (h *Harness) Exited() (code int, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.exitCode, h.exited
+}
+
+// Phases returns the lifecycle phases in order, see grace.Events. the phases are
+// sent before Restart or Stop returns, so they are all here after that.
+func (h *Harness) Phases() []grace.Phase {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for {
+		select {
+		case e := <-grace.Events():
+			h.phases = append(h.phases, e.Phase)
+		default:
+			return append([]grace.Phase{}, h.phases...)
+		}
+	}
+}
+
+func (h *Harness) start() (*os.Process, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.starts++
+	if h.startErr != nil {
+		return nil, h.startErr
+	}
+	return &os.Process{Pid: FakePID}, nil
+}
+
+func (h *Harness) exit(code int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.exited = true
+	h.exitCode = code
+}
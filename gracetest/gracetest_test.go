@@ -0,0 +1,119 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package gracetest
+
+import (
+	"net"
+	"errors"
+	"reflect"
+	"testing"
+	"gopkg.in/orivil/grace.v1"
+)
+
+func listen(t *testing.T, m *grace.Manager) net.Listener {
+
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestRestart(t *testing.T) {
+
+	h := New(t)
+	m := grace.NewManager()
+	l := listen(t, m)
+
+	var closed bool
+	m.AfterCloseCall(func() { closed = true })
+
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Starts() != 1 {
+		t.Fatalf("started %d times, want 1", h.Starts())
+	}
+	if !closed {
+		t.Fatal("the close callback is not called")
+	}
+	if _, err := l.Accept(); err != grace.ErrServerClosed {
+		t.Fatalf("Accept() = %v, want %v", err, grace.ErrServerClosed)
+	}
+	if code, ok := h.Exited(); !ok || code != 0 {
+		t.Fatalf("exited: %v, code %d", ok, code)
+	}
+
+	want := []grace.Phase{
+		grace.PhaseChildStarted,
+		grace.PhaseDraining,
+		grace.PhaseListenersClosed,
+		grace.PhaseDrained,
+		grace.PhaseExiting,
+	}
+	if got := h.Phases(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("phases %v, want %v", got, want)
+	}
+}
+
+func TestStop(t *testing.T) {
+
+	h := New(t)
+	m := grace.NewManager()
+	l := listen(t, m)
+
+	m.Stop()
+
+	if h.Starts() != 0 {
+		t.Fatalf("started %d times by Stop", h.Starts())
+	}
+	if _, ok := h.Exited(); !ok {
+		t.Fatal("not exited")
+	}
+	if _, err := l.Accept(); err != grace.ErrServerClosed {
+		t.Fatalf("Accept() = %v, want %v", err, grace.ErrServerClosed)
+	}
+	if got := h.Phases(); len(got) == 0 || got[0] != grace.PhaseDraining {
+		t.Fatalf("phases %v", got)
+	}
+}
+
+func TestFailStart(t *testing.T) {
+
+	h := New(t)
+	m := grace.NewManager()
+	l := listen(t, m)
+
+	errStart := errors.New("start failed")
+	h.FailStart(errStart)
+	if err := m.Restart(); err != errStart {
+		t.Fatalf("Restart() = %v, want %v", err, errStart)
+	}
+	if _, ok := h.Exited(); ok {
+		t.Fatal("exited after a failed restart")
+	}
+
+	// the current process keeps serving.
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// the next restart is not blocked by the failed one.
+	h.FailStart(nil)
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Starts() != 2 {
+		t.Fatalf("started %d times, want 2", h.Starts())
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package gracews drains the WebSockets of package gorilla/websocket, the clients
+// get a close frame "going away" when the drain begins, so they reconnect to the
+// new process, e.g.:
+//
+//	ws, err := upgrader.Upgrade(w, r, nil)
+//	if err != nil {
+//		return
+//	}
+//	defer ws.Close()
+//	gracews.Track(ws)
+//
+// the server must be started by package grace, e.g. grace.ListenAndServe.
+package gracews
+
+import (
+	"time"
+	"gopkg.in/orivil/grace.v1"
+	"github.com/gorilla/websocket"
+)
+
+// closeTimeout is the write deadline of the close frame.
+const closeTimeout = time.Second
+
+// Track registers the WebSocket, a close frame with the code CloseGoingAway is sent
+// when the drain begins. the read loop of the handler gets the close error after
+// the client replied, then the handler returns and closes the connection. it
+// returns false if the connection is not accepted by a graceful listener, see
+// grace.TrackConn.
+func Track(ws *websocket.Conn) bool {
+
+	return grace.TrackConn(ws.NetConn(), func() {
+
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server restarting")
+		ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	})
+}
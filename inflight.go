@@ -0,0 +1,80 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RequestInfo describes an in-flight request of the graceful http servers.
+type RequestInfo struct {
+	Method     string        `json:"method"`
+	Path       string        `json:"path"`
+	RemoteAddr string        `json:"remote_addr"`
+	Start      time.Time     `json:"start"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// String returns like "POST /slow-upload (42s)".
+func (r RequestInfo) String() string {
+
+	return fmt.Sprintf("%s %s (%s)", r.Method, r.Path, r.Duration.Round(time.Second))
+}
+
+var inFlight = struct {
+	requests map[uint64]RequestInfo
+	nextID   uint64
+	sync.Mutex
+}{requests: make(map[uint64]RequestInfo)}
+
+// InFlightRequests returns the requests being handled by the graceful http servers,
+// the longest running request first. it shows which handlers are blocking a slow
+// drain, e.g. in an admin endpoint.
+func InFlightRequests() []RequestInfo {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+
+	now := time.Now()
+	requests := make([]RequestInfo, 0, len(inFlight.requests))
+	for _, r := range inFlight.requests {
+		r.Duration = now.Sub(r.Start)
+		requests = append(requests, r)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Start.Before(requests[j].Start)
+	})
+	return requests
+}
+
+// trackRequests records the in-flight requests of the handler.
+func trackRequests(h http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		inFlight.Lock()
+		id := inFlight.nextID
+		inFlight.nextID++
+		inFlight.requests[id] = RequestInfo{
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+			Start:      time.Now(),
+		}
+		inFlight.Unlock()
+
+		defer func() {
+			inFlight.Lock()
+			delete(inFlight.requests, id)
+			inFlight.Unlock()
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,364 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// HandoffMode is the way how the sockets are passed to the child process.
+type HandoffMode int
+
+const (
+	// HandoffPipe passes the sockets' addresses and file descriptors through
+	// a pipe, it's the default mode.
+	HandoffPipe HandoffMode = iota
+
+	// HandoffEnv passes the sockets like systemd: the sockets start from fd
+	// 3, the env var "GRACE_LISTEN_FDS" is the number of the sockets, and the
+	// env var "GRACE_LISTEN_ADDRS" is the comma-separated addresses in the same
+	// order. it works with process managers which pass fds by env vars, note
+	// that the addresses must not contain commas.
+	HandoffEnv
+)
+
+const (
+	envListenFDs   = "GRACE_LISTEN_FDS"
+	envListenAddrs = "GRACE_LISTEN_ADDRS"
+)
+
+var handoffMode = HandoffPipe
+
+// SetHandoffMode sets the way how the sockets are passed to the child process,
+// the child process detects the mode by itself.
+func SetHandoffMode(mode HandoffMode) {
+
+	handoffMode = mode
+}
+
+// handoffEnv returns the env vars of the HandoffEnv mode, the caller must hold
+// the socketLock.
+func handoffEnv() []string {
+
+	return []string{
+		fmt.Sprintf("%s=%d", envListenFDs, len(socketFiles)),
+		fmt.Sprintf("%s=%s", envListenAddrs, strings.Join(socketAddrs, ",")),
+	}
+}
+
+// inheritEnvSocketFiles inherits the socket files passed by the HandoffEnv mode.
+func inheritEnvSocketFiles() error {
+
+	n, err := strconv.Atoi(os.Getenv(envListenFDs))
+	if err != nil {
+		return fmt.Errorf("grace: invalid %s: %v", envListenFDs, err)
+	}
+
+	var addrs []string
+	if n > 0 {
+		addrs = strings.Split(os.Getenv(envListenAddrs), ",")
+	}
+	if len(addrs) != n {
+		return errors.New("grace: " + envListenAddrs + " doesn't match " + envListenFDs)
+	}
+
+	// don't pass the env vars to the grandchild process.
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenAddrs)
+
+	index := make(map[string]uintptr, n)
+	for i, addr := range addrs {
+		index[addr] = uintptr(3 + i)
+	}
+	inheritSocketFiles(index)
+	return nil
+}
+
+var (
+	// addresses of the socket files, in the same order.
+	socketAddrs []string
+
+	// addresses of all the socket files inherited from the parent process.
+	inheritedAddrs []string
+
+	// inherited socket files which are not used by NewListener yet.
+	unclaimed = make(map[string]*os.File)
+
+	socketLock sync.Mutex
+
+	// how long the child process keeps the unclaimed socket files open.
+	inheritGracePeriod = time.Minute
+
+	// closes the unclaimed socket files, guarded by socketLock.
+	unclaimedTimer *time.Timer
+)
+
+// SetInheritGracePeriod sets how long the child process keeps the inherited socket
+// files open for NewListener(and the files for InheritedFile), counted from the
+// process started, the ones not used in time will be closed. the default is one
+// minute, 0 means never close them.
+//
+// the socket files are passed at restart time, so the listeners created lazily
+// (e.g. after ListenSignal, on the first request) are inherited too, as long as
+// they are created before the restart. but in the child process, the lazy
+// listeners must be created within the grace period, or increase the period.
+func SetInheritGracePeriod(d time.Duration) {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	inheritGracePeriod = d
+	if unclaimedTimer == nil {
+		return
+	}
+
+	unclaimedTimer.Stop()
+	if d > 0 {
+		unclaimedTimer.Reset(d - time.Since(startTime))
+	}
+}
+
+// addSocketFile stores the socket file, it will be passed to the child process.
+func addSocketFile(addr string, f *os.File) {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	socketFiles = append(socketFiles, f)
+	socketAddrs = append(socketAddrs, addr)
+}
+
+// inheritedFilePrefix prefixes the names of the files registered by
+// RegisterInheritedFile, so they never conflict with the socket addresses.
+const inheritedFilePrefix = "file:"
+
+// RegisterInheritedFile registers an opened file to be inherited by the child
+// process under "name", the child process gets it by InheritedFile. e.g. a log
+// file, the child process continues writing to the same opened file rather than
+// reopening it:
+//
+//	f := grace.InheritedFile("app.log")
+//	if f == nil {
+//		f, err = os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+//		...
+//	}
+//	grace.RegisterInheritedFile("app.log", f)
+//
+// registering the same name again replaces the file. like the sockets, the child
+// process closes the inherited files which are not claimed by InheritedFile within
+// the inherit grace period.
+func RegisterInheritedFile(name string, f *os.File) {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	name = inheritedFilePrefix + name
+	for i, addr := range socketAddrs {
+		if addr == name {
+			socketFiles[i] = f
+			return
+		}
+	}
+
+	socketFiles = append(socketFiles, f)
+	socketAddrs = append(socketAddrs, name)
+}
+
+// InheritedFile returns the file registered by the parent process with
+// RegisterInheritedFile, returns nil if the file was not inherited. the file is
+// registered for the next restart automatically.
+func InheritedFile(name string) *os.File {
+
+	return claimSocketFile(inheritedFilePrefix + name)
+}
+
+// inheritSocketFiles stores the socket files inherited from the parent process,
+// "index" maps the addresses to the file descriptors.
+func inheritSocketFiles(index map[string]uintptr) {
+
+	files := make(map[string]*os.File, len(index))
+	for addr, fd := range index {
+		files[addr] = os.NewFile(fd, addr)
+	}
+	inheritFiles(index, files)
+}
+
+// inheritFiles stores the opened socket files, "index" maps the addresses to
+// the file descriptors, "files" maps the addresses to the files.
+func inheritFiles(index map[string]uintptr, files map[string]*os.File) {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	addrs := make([]string, 0, len(index))
+	for addr := range index {
+		addrs = append(addrs, addr)
+	}
+
+	// keep the order of the parent process.
+	sort.Slice(addrs, func(i, j int) bool {
+		return index[addrs[i]] < index[addrs[j]]
+	})
+
+	inheritedAddrs = addrs
+	for _, addr := range addrs {
+		f := files[addr]
+		socketFiles = append(socketFiles, f)
+		socketAddrs = append(socketAddrs, addr)
+		unclaimed[addr] = f
+		addPendingSocket(addr)
+	}
+
+	// nothing to wait for.
+	if len(pendingSockets) == 0 {
+		markReady()
+	}
+
+	if len(unclaimed) > 0 && inheritGracePeriod > 0 {
+		unclaimedTimer = time.AfterFunc(inheritGracePeriod, closeUnclaimed)
+	}
+}
+
+// ListenError is returned by NewListener(and NewPacketConn, NewListenerReusePort)
+// if the address can't be bound.
+type ListenError struct {
+	Network string
+	Addr    string
+
+	// Inherited is true if the process was started by a restart but the address
+	// was not among the sockets inherited from the parent process, so it was bound
+	// again, which usually fails because the parent process still holds the
+	// address. it often means the parent and the child process listen on different
+	// "addr" strings(e.g. ":8080" and "0.0.0.0:8080"), see InheritedAddrs.
+	Inherited bool
+
+	// addresses of the sockets inherited from the parent process.
+	InheritedAddrs []string
+
+	Err error
+}
+
+func (e *ListenError) Error() string {
+
+	if e.Inherited {
+		return fmt.Sprintf(
+			"grace: listen %s %s: %v (the address was not inherited from the parent process, inherited: %s)",
+			e.Network, e.Addr, e.Err, strings.Join(e.InheritedAddrs, ", "),
+		)
+	}
+	return fmt.Sprintf("grace: listen %s %s: %v", e.Network, e.Addr, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+
+	return e.Err
+}
+
+// listenError returns the ListenError of the failed bind.
+func listenError(network, addr string, err error) error {
+
+	e := &ListenError{Network: network, Addr: addr, Err: err}
+	if osSupportSocketFile && isChildProcess {
+		socketLock.Lock()
+		e.Inherited = true
+		e.InheritedAddrs = append([]string{}, inheritedAddrs...)
+		socketLock.Unlock()
+	}
+	return e
+}
+
+// claimSocketFile returns the inherited socket file of the address, returns nil
+// if the address was not inherited.
+func claimSocketFile(addr string) *os.File {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	f := unclaimed[addr]
+	if f == nil {
+
+		// the systemd sockets are keyed by their local addresses, a named socket
+		// may be claimed already.
+		if key := systemdKey(addr); key != "" {
+			if f = unclaimed[key]; f == nil {
+				return nil
+			}
+			renameSocketFile(key, addr)
+			delete(unclaimed, key)
+			claimPendingSocket(key)
+			return f
+		}
+	}
+
+	delete(unclaimed, addr)
+	if f != nil {
+		claimPendingSocket(addr)
+	}
+	return f
+}
+
+// renameSocketFile replaces the address of the socket file, so the child process
+// matches it by the new address. the caller must hold the socketLock.
+func renameSocketFile(from, to string) {
+
+	for i, addr := range socketAddrs {
+		if addr == from {
+			socketAddrs[i] = to
+		}
+	}
+}
+
+// closeUnclaimed closes the inherited socket files never used by NewListener,
+// e.g. the new executable file doesn't listen on some address any more, so
+// they won't leak into the process and its children.
+func closeUnclaimed() {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	if len(unclaimed) == 0 {
+		return
+	}
+
+	var files []*os.File
+	var addrs []string
+	for i, f := range socketFiles {
+		addr := socketAddrs[i]
+		if unclaimed[addr] == f {
+			logf("close unused inherited socket: %s\n", addr)
+			f.Close()
+			continue
+		}
+		files = append(files, f)
+		addrs = append(addrs, addr)
+	}
+
+	socketFiles, socketAddrs = files, addrs
+	unclaimed = make(map[string]*os.File)
+
+	// nothing left to wait for.
+	markReady()
+}
+
+// extraFileIndex maps the addresses to the file descriptors of the child process,
+// the descriptors are derived from the positions of the socket files in "files",
+// the extra files of the child process start from fd 3. the caller must hold the
+// socketLock.
+func extraFileIndex(files []*os.File) map[string]uintptr {
+
+	addrs := make(map[*os.File]string, len(socketFiles))
+	for i, f := range socketFiles {
+		addrs[f] = socketAddrs[i]
+	}
+
+	index := make(map[string]uintptr, len(socketFiles))
+	for i, f := range files {
+		if addr, ok := addrs[f]; ok {
+			index[addr] = uintptr(3 + i)
+		}
+	}
+	return index
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"path/filepath"
+)
+
+func TestRestartKeepsInterfaceBinding(t *testing.T) {
+
+	addrs := []string{"127.0.0.1:0"}
+
+	// the whole 127.0.0.0/8 is bound to the loopback interface on linux, so a
+	// second local address is available.
+	if runtime.GOOS == "linux" {
+		addrs = append(addrs, "127.0.0.2:0")
+	}
+
+	var listen []string
+	for _, addr := range addrs {
+		listen = append(listen, "tcp|"+addr)
+	}
+	report := realRestart(t, listen...)
+
+	m := newTestManager(t)
+	bound := make(map[string]string)
+	for _, addr := range addrs {
+		l, err := m.NewListener("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bound[addr] = l.Addr().String()
+	}
+
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := readReport(t, report, 1)
+	for _, addr := range addrs {
+		if !strSliceContains(child.Inherited, addr) {
+			t.Errorf("%s is not inherited: %v", addr, child.Inherited)
+		}
+
+		// the child process serves the same socket, on the same interface.
+		if child.Addrs[addr] != bound[addr] {
+			t.Errorf("%s: child process bound %s, want %s", addr, child.Addrs[addr], bound[addr])
+		}
+		host, _, _ := net.SplitHostPort(child.Addrs[addr])
+		if want, _, _ := net.SplitHostPort(addr); host != want {
+			t.Errorf("%s: interface changed to %s", addr, host)
+		}
+	}
+}
+
+func TestRestartInheritsLazyListener(t *testing.T) {
+
+	report := realRestart(t, "tcp|127.0.0.1:0")
+
+	m := newTestManager(t)
+	m.ListenSignal()
+
+	// created after ListenSignal, e.g. on the first request.
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := readReport(t, report, 1)
+	if got := child.Addrs["127.0.0.1:0"]; got != l.Addr().String() {
+		t.Fatalf("child process bound %s, want the inherited %s", got, l.Addr())
+	}
+}
+
+// noFileListener hides the File method of the listener.
+type noFileListener struct {
+	net.Listener
+}
+
+func TestRestartSkipsListenerWithoutFile(t *testing.T) {
+
+	sock := filepath.Join(t.TempDir(), "grace.sock")
+	report := realRestart(t, "tcp|127.0.0.1:0", "unix|"+sock)
+
+	m := newTestManager(t)
+	first, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the socket of the listener in the middle can't be passed.
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WrapListener(noFileListener{raw}); err != nil {
+		t.Fatal(err)
+	}
+
+	last, err := m.NewListener("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sockets after the skipped one still match their addresses.
+	child := readReport(t, report, 1)
+	if got := child.Addrs["127.0.0.1:0"]; got != first.Addr().String() {
+		t.Errorf("child process bound %s, want %s", got, first.Addr())
+	}
+	if got := child.Addrs[sock]; got != last.Addr().String() || !strSliceContains(child.Inherited, sock) {
+		t.Errorf("child process bound %s, want the inherited %s", got, last.Addr())
+	}
+}
+
+// a systemd socket claimed by its name can't be claimed again.
+func TestClaimSocketFileClaimedSystemdName(t *testing.T) {
+
+	socketLock.Lock()
+	socketAddrs = []string{"127.0.0.1:8080"}
+	systemdNames["web"] = "127.0.0.1:8080"
+	pendingSockets["127.0.0.1:9090"] = true
+	socketLock.Unlock()
+
+	defer func() {
+		socketLock.Lock()
+		socketAddrs = nil
+		delete(systemdNames, "web")
+		delete(pendingSockets, "127.0.0.1:9090")
+		socketLock.Unlock()
+	}()
+
+	if f := claimSocketFile("web"); f != nil {
+		t.Fatal("claimed a socket file twice")
+	}
+
+	socketLock.Lock()
+	defer socketLock.Unlock()
+	if socketAddrs[0] != "127.0.0.1:8080" {
+		t.Fatalf("the socket file is renamed to %q", socketAddrs[0])
+	}
+	if !pendingSockets["127.0.0.1:9090"] {
+		t.Fatal("the pending sockets changed")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package testhook connects package grace with package gracetest, it replaces
+// the start of the child process and the exit of the process in tests.
+package testhook
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	lock sync.Mutex
+
+	start func() (*os.Process, error)
+
+	exit func(code int)
+
+	// Reset resets the restart state of package grace, it's set by grace.
+	Reset func()
+)
+
+// SetStart replaces the start of the child process, nil restores the default.
+func SetStart(f func() (*os.Process, error)) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	start = f
+}
+
+// Start returns the replaced start of the child process, or nil.
+func Start() func() (*os.Process, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return start
+}
+
+// SetExit replaces the exit of the process, nil restores the default.
+func SetExit(f func(code int)) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	exit = f
+}
+
+// Exit returns the replaced exit of the process, or nil.
+func Exit() func(code int) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return exit
+}
@@ -0,0 +1,108 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reason tells the close callbacks why the process is closing.
+type Reason int
+
+const (
+
+	// ReasonRestart means a new process takes over the listeners.
+	ReasonRestart Reason = iota
+
+	// ReasonStop means the process stops by Stop or the admin command.
+	ReasonStop
+
+	// ReasonSignal means the process stops by a signal.
+	ReasonSignal
+)
+
+func (r Reason) String() string {
+
+	switch r {
+	case ReasonRestart:
+		return "restart"
+	case ReasonStop:
+		return "stop"
+	case ReasonSignal:
+		return "signal"
+	}
+	return "unknown"
+}
+
+// closeReason returns why the process is closing.
+func closeReason() Reason {
+
+	if atomic.LoadInt32(&restarting) == 1 {
+		return ReasonRestart
+	}
+	if strings.HasPrefix(getExitReason(), "signal:") {
+		return ReasonSignal
+	}
+	return ReasonStop
+}
+
+// BeforeCloseCallCtx acts like BeforeCloseCall, but the callback gets the reason of
+// the closing and a context which carries the drain deadline, the context has no
+// deadline if the drain waits without timeout(e.g. Stop).
+func BeforeCloseCallCtx(callback func(ctx context.Context, reason Reason)) {
+
+	defaultManager.BeforeCloseCallCtx(callback)
+}
+
+// AfterCloseCallCtx acts like AfterCloseCallE, but the callback gets the reason of
+// the closing and a context which carries the drain deadline, e.g. a backup can be
+// aborted gracefully if the deadline is near.
+func AfterCloseCallCtx(callback func(ctx context.Context, reason Reason) error) {
+
+	defaultManager.AfterCloseCallCtx(callback)
+}
+
+// BeforeCloseCallCtx acts like the package function BeforeCloseCallCtx.
+func (m *Manager) BeforeCloseCallCtx(callback func(ctx context.Context, reason Reason)) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.beforeCloseCalls = append(m.beforeCloseCalls, callback)
+}
+
+// AfterCloseCallCtx acts like the package function AfterCloseCallCtx.
+func (m *Manager) AfterCloseCallCtx(callback func(ctx context.Context, reason Reason) error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.afterCloseCalls = append(m.afterCloseCalls, callback)
+}
+
+// setDrainDeadline sets the deadline of the drain, zero means no deadline.
+func (m *Manager) setDrainDeadline(deadline time.Time) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.drainDeadline = deadline
+}
+
+// closeContext returns the context of the close callbacks.
+func (m *Manager) closeContext() (context.Context, context.CancelFunc) {
+
+	m.lock.Lock()
+	deadline := m.drainDeadline
+	m.lock.Unlock()
+
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// ListenSpec describes a listener of ListenAll.
+type ListenSpec struct {
+	Network string
+	Addr    string
+
+	// TLSConfig wraps the listener with TLS if it's not nil.
+	TLSConfig *tls.Config
+}
+
+// ListenAll creates the graceful listeners of all the specs, e.g. ":80" for the
+// redirect and ":443", they are drained, stopped and passed to the child process
+// together like the listeners created by NewListener. the listeners are returned in
+// the same order as the specs, if any of them failed, the listeners already created
+// are closed and the error is returned.
+func ListenAll(specs []ListenSpec) ([]net.Listener, error) {
+
+	return defaultManager.ListenAll(specs)
+}
+
+// ListenAll acts like the package function ListenAll, the listeners belong to the
+// manager.
+func (m *Manager) ListenAll(specs []ListenSpec) ([]net.Listener, error) {
+
+	seen := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		if seen[spec.Addr] {
+			return nil, fmt.Errorf("grace: duplicated address %q", spec.Addr)
+		}
+		seen[spec.Addr] = true
+	}
+
+	// the graceful listeners, without the TLS wrappers.
+	created := make([]net.Listener, 0, len(specs))
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+
+		l, err := m.NewListener(spec.Network, spec.Addr)
+		if err != nil {
+			for i, c := range created {
+				m.releaseListener(c, specs[i].Addr)
+			}
+			return nil, err
+		}
+		created = append(created, l)
+
+		if spec.TLSConfig != nil {
+			l = tls.NewListener(l, spec.TLSConfig)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// releaseListener closes the listener created by NewListener and stops passing its
+// socket to the child process, an inherited socket becomes unclaimed again.
+func (m *Manager) releaseListener(l net.Listener, addr string) {
+
+	m.lock.Lock()
+	for i, ml := range m.listeners {
+		if ml == l {
+			m.listeners = append(m.listeners[:i:i], m.listeners[i+1:]...)
+			break
+		}
+	}
+	m.lock.Unlock()
+	l.Close()
+
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	for i, a := range socketAddrs {
+		if a != addr {
+			continue
+		}
+
+		if strSliceContains(inheritedAddrs, addr) {
+			unclaimed[addr] = socketFiles[i]
+			return
+		}
+
+		socketFiles[i].Close()
+		socketFiles = append(socketFiles[:i:i], socketFiles[i+1:]...)
+		socketAddrs = append(socketAddrs[:i:i], socketAddrs[i+1:]...)
+		return
+	}
+}
@@ -6,24 +6,41 @@
 package grace
 
 import (
-	"flag"
+	"context"
 	"os"
-	"os/exec"
 	"net"
 	"runtime"
 	"os/signal"
 	"syscall"
 	"sync"
+	"sync/atomic"
 	"encoding/json"
-	"gopkg.in/orivil/log.v0"
-	"github.com/fsnotify/fsnotify"
 	"time"
 	"fmt"
-	"path/filepath"
+	"errors"
+	"net/http"
+	"strconv"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
 )
 
+// graceTag is the flag which marked the child process in the old versions.
 const graceTag = "graceful"
 
+const (
+	// envChild marks the child process.
+	envChild = "GRACE_CHILD"
+
+	// envParentPID passes the parent's pid to the child process.
+	envParentPID = "GRACE_PARENT_PID"
+
+	// envGeneration passes the generation of the child process.
+	envGeneration = "GRACE_GENERATION"
+
+	// envRestartCount is the number of restarts since the cold start, it's kept
+	// in the environment for the application, unset means a cold start.
+	envRestartCount = "GRACE_RESTART_COUNT"
+)
+
 var (
 	isChildProcess bool
 
@@ -31,28 +48,23 @@ var (
 
 	socketFiles []*os.File
 
-	listeners []net.Listener
+	pid = os.Getpid()
 
-	socketIndex = make(map[string]uintptr)
+	parentPID int
 
-	waitGroup = sync.WaitGroup{}
+	generation int
 
-	pid = os.Getpid()
+	// number of the opened connects of all managers.
+	activeConns int64
 
-	closeSig = struct {
-		closed bool
-		sync.RWMutex
-	}{}
+	// 1 if the process is restarting.
+	restarting int32
 )
 
 var (
-	logf = func(format string, args... interface{}) {
-
-		log.Printf(fmt.Sprintf("[process: %d] ", pid) + format, args...)
-	}
-
-	beforeCloseCalls []func()
-	afterCloseCalls []func()
+	flushers []func(ctx context.Context) error
+	flushersLock sync.Mutex
+	flushTimeout = 5 * time.Second
 )
 
 // BeforeCloseCall caches callbacks, they will be run before the process exited.
@@ -60,67 +72,449 @@ var (
 // most of time, we can pass some notices to the client.
 func BeforeCloseCall(callback func()) {
 
-	beforeCloseCalls = append(beforeCloseCalls, callback)
+	defaultManager.BeforeCloseCall(callback)
 }
 
-// BeforeCloseCall caches callbacks, they will be run before the process exited.
+// BeforeCloseCall acts like the package function BeforeCloseCall, the callbacks
+// will be run before the listeners of the manager closed.
+func (m *Manager) BeforeCloseCall(callback func()) {
+
+	m.BeforeCloseCallCtx(func(context.Context, Reason) {
+		callback()
+	})
+}
+
+// AfterCloseCall caches callbacks, they will be run before the process exited.
 // unlike BeforeCloseCall, the callbacks will be run after all listeners and
 // connections closed. most of time, we can backup data here.
+//
+// a callback must not call os.Exit(e.g. log.Fatal), which exits the process at
+// once, skips the remaining callbacks and the flushers, and may exit with a
+// misleading code. return the error by AfterCloseCallE instead.
 func AfterCloseCall(callback func()) {
 
-	afterCloseCalls = append(afterCloseCalls, callback)
+	defaultManager.AfterCloseCall(callback)
+}
+
+// AfterCloseCallE acts like AfterCloseCall, but the callback returns an error, the
+// error will be logged and the remaining callbacks still run.
+func AfterCloseCallE(callback func() error) {
+
+	defaultManager.AfterCloseCallE(callback)
+}
+
+// AfterCloseCall acts like the package function AfterCloseCall, the callbacks
+// will be run after the listeners and connections of the manager closed.
+func (m *Manager) AfterCloseCall(callback func()) {
+
+	m.AfterCloseCallE(func() error {
+		callback()
+		return nil
+	})
+}
+
+// AfterCloseCallE acts like the package function AfterCloseCallE.
+func (m *Manager) AfterCloseCallE(callback func() error) {
+
+	m.AfterCloseCallCtx(func(context.Context, Reason) error {
+		return callback()
+	})
+}
+
+// runCallback runs the close callback, a panic in the callback is recovered
+// and returned as an error, so the remaining callbacks still run.
+func runCallback(callback func() error) (err error) {
+
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return callback()
+}
+
+// RegisterFlusher caches flushers, they will be run in order after all listeners
+// and connections closed and after the AfterCloseCall callbacks, just before the
+// process exited. all flushers share one context which expires after the flush
+// timeout(see SetFlushTimeout), errors returned by flushers will be logged.
+//
+// most of time, we flush buffered telemetry here, e.g. OpenTelemetry spans:
+//
+//	grace.RegisterFlusher(tracerProvider.ForceFlush)
+func RegisterFlusher(flusher func(ctx context.Context) error) {
+
+	flushersLock.Lock()
+	defer flushersLock.Unlock()
+
+	flushers = append(flushers, flusher)
+}
+
+// SetFlushTimeout sets the deadline of the flushers, the default is 5 seconds.
+func SetFlushTimeout(d time.Duration) {
+
+	flushTimeout = d
+}
+
+// runFlushers runs all flushers, it returns the first error.
+func runFlushers() (first error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	flushersLock.Lock()
+	fs := append([]func(ctx context.Context) error{}, flushers...)
+	flushersLock.Unlock()
+
+	for _, f := range fs {
+
+		if err := f(ctx); err != nil {
+			logf("flush failed! %v\n", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
 }
 
 type supportSocketFile interface {
 	File() (f *os.File, err error)
 }
 
+// maxConnLifetime is the maximum lifetime of connections in nanoseconds.
+var maxConnLifetime int64
+
+// MaxConnLifetime sets the maximum lifetime of the connections accepted by the
+// graceful listeners, a connection will be closed after "d" from the accept time
+// regardless of activity, e.g. to force clients reconnect periodically to pick up
+// new auth. "d" less than or equal to 0 means unlimited, which is the default.
+func MaxConnLifetime(d time.Duration) {
+
+	atomic.StoreInt64(&maxConnLifetime, int64(d))
+}
+
+// connIdleTimeout is the idle timeout of the raw connections in nanoseconds.
+var connIdleTimeout int64
+
+// ConnIdleTimeout sets the idle timeout of the raw connections accepted by the
+// graceful listeners(e.g. by ListenNetAndServe), a connection is closed if a read
+// waits longer than "d", the deadline is reset before every read. so a stuck client
+// won't hold the drain of a restart forever. the connections of the graceful http
+// servers are not affected, use http.Server.IdleTimeout there. an earlier read
+// deadline set by the application is kept, its timeout doesn't close the connection.
+// "d" less than or equal to 0 means no timeout, which is the default.
+func ConnIdleTimeout(d time.Duration) {
+
+	atomic.StoreInt64(&connIdleTimeout, int64(d))
+}
+
+// connWrapper wraps the accepted connections, nil means no wrapping.
+var connWrapper func(net.Conn) net.Conn
+
+// ConnWrapper sets a function to wrap every connection accepted by the graceful
+// listeners before it reaches the handler, e.g. for byte counting or logging. it
+// must be called before the listeners created.
+//
+// the wrapper receives the graceful connection, the wrapped connection's Close must
+// call the graceful connection's Close, or the process will wait for the connection
+// forever when stopping. the wrapped connection should implement
+// "NetConn() net.Conn" returning the graceful connection, so that functions like
+// TagConn can find it.
+func ConnWrapper(wrap func(net.Conn) net.Conn) {
+
+	connWrapper = wrap
+}
+
+func wrapConn(c net.Conn) net.Conn {
+
+	if connWrapper == nil {
+		return c
+	}
+	return connWrapper(c)
+}
+
 type netConn struct {
 	net.Conn
+
+	// the manager of the listener which accepted the connection.
+	m *Manager
+
+	// address of the listener which accepted the connection.
+	addr string
+
+	// the accept time.
+	accepted time.Time
+
+	// closes the connection when its lifetime expired.
+	lifetime *time.Timer
+
+	// set by TagConn, guarded by connsLock.
+	tag string
+
+	// set by TrackConn, guarded by connsLock.
+	onDrain func()
+
+	// 1 if any data was transferred.
+	used int32
+
+	// 1 if the connection is idle, see SetConnIdle.
+	idle int32
+
+	// 1 if the connection is served by a graceful http server.
+	http int32
+
+	// 1 if the connection is not tracked any more.
+	released int32
+
+	// the read deadline set by the application in unix nanoseconds, zero means
+	// no deadline.
+	readDeadline int64
+}
+
+func (n *netConn) Read(b []byte) (int, error) {
+
+	// the http server manages the deadlines by itself, an earlier read deadline
+	// set by the application is kept.
+	timeout := time.Duration(atomic.LoadInt64(&connIdleTimeout))
+	idle := timeout > 0 && atomic.LoadInt32(&n.http) == 0
+	if idle {
+		deadline := time.Now().Add(timeout)
+		if user := atomic.LoadInt64(&n.readDeadline); user != 0 && user <= deadline.UnixNano() {
+			idle = false
+			n.Conn.SetReadDeadline(time.Unix(0, user))
+		} else {
+			n.Conn.SetReadDeadline(deadline)
+		}
+	}
+
+	nr, err := n.Conn.Read(b)
+	if nr > 0 {
+		n.markUsed()
+	}
+
+	// only the idle timeout closes the connection.
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && idle {
+		logf("close idle connect: %s\n", n.RemoteAddr())
+		n.Close()
+	}
+	return nr, err
+}
+
+func (n *netConn) SetDeadline(t time.Time) error {
+
+	n.setReadDeadline(t)
+	return n.Conn.SetDeadline(t)
+}
+
+func (n *netConn) SetReadDeadline(t time.Time) error {
+
+	n.setReadDeadline(t)
+	return n.Conn.SetReadDeadline(t)
+}
+
+// setReadDeadline records the read deadline set by the application, Read sets
+// the idle deadline only if it's earlier, see ConnIdleTimeout.
+func (n *netConn) setReadDeadline(t time.Time) {
+
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	atomic.StoreInt64(&n.readDeadline, deadline)
+}
+
+func (n *netConn) Write(b []byte) (int, error) {
+
+	nw, err := n.Conn.Write(b)
+	if nw > 0 {
+		n.markUsed()
+	}
+	return nw, err
+}
+
+func (n *netConn) markUsed() {
+
+	if atomic.LoadInt32(&n.used) == 0 {
+		atomic.StoreInt32(&n.used, 1)
+	}
+}
+
+func newNetConn(m *Manager, addr string, c net.Conn) *netConn {
+
+	n := &netConn{Conn: c, m: m, addr: addr, accepted: time.Now()}
+	if d := time.Duration(atomic.LoadInt64(&maxConnLifetime)); d > 0 {
+
+		// only close the underlying connection, the handler will get an
+		// error and close the netConn.
+		n.lifetime = time.AfterFunc(d, func() {
+			c.Close()
+		})
+	}
+	trackConn(n)
+	return n
 }
 
+// Close closes the connection, it's safe to be called more than once, e.g. by the
+// handler and by the deferred Close of ListenNetAndServe, only the first call
+// releases the connection, see release.
 func (n *netConn) Close() error {
 
+	if n.lifetime != nil {
+		n.lifetime.Stop()
+	}
+
 	err := n.Conn.Close()
-	waitGroup.Done()
+
+	// the connection was accepted, but closed during the drain before any
+	// data transferred.
+	if n.release() && atomic.LoadInt32(&n.used) == 0 && n.m.isClosed() {
+		atomic.AddInt64(&droppedConns, 1)
+	}
 	return err
 }
 
+// release stops tracking the connection, the process won't wait for it any more.
+// it reports whether the connection was tracked.
+func (n *netConn) release() bool {
+
+	if !atomic.CompareAndSwapInt32(&n.released, 0, 1) {
+		return false
+	}
+
+	untrackConn(n)
+	atomic.AddInt64(&activeConns, -1)
+	atomic.AddInt64(&n.m.activeConns, -1)
+	releaseConnSlot()
+	n.m.waitGroup.Done()
+	return true
+}
+
 type netListener struct {
 	net.Listener
+
+	m *Manager
+
+	// true if the listener is served by a graceful http server without TLS,
+	// see OverflowRespond503.
+	plainHTTP bool
+
+	// path of the unix socket file which is removed on the final stop.
+	unixPath string
+
+	// 1 if Accept returns right after the drain, see ReturnOnDrain.
+	returnOnDrain int32
+}
+
+// Close closes the listener, the unix socket file is kept if the process is
+// restarting, the child process inherits the socket.
+func (n *netListener) Close() error {
+
+	err := n.Listener.Close()
+	if n.unixPath != "" && atomic.LoadInt32(&restarting) == 0 {
+		os.Remove(n.unixPath)
+	}
+	return err
+}
+
+// ErrServerClosed is returned by Accept of the graceful listeners after the
+// manager stopped by StopGraceful or StopWithTimeout, so a graceful stop can be
+// told from a real listener error. it's the same as http.ErrServerClosed, the
+// graceful http servers return it too, e.g.:
+//
+//	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+//		log.Fatal(err)
+//	}
+//
+// while the process exits by Stop, Accept blocks after the drain instead, the
+// server doesn't return before the opened connects closed, see ReturnOnDrain.
+var ErrServerClosed = http.ErrServerClosed
+
+// ReturnOnDrain makes Accept of the graceful listener "l" return ErrServerClosed
+// as soon as the drain began, rather than blocking until the manager stopped. it's
+// for the servers which wait for their accept loop before closing the opened
+// connects, e.g. http.Server.Shutdown and grpc.Server.GracefulStop would wait
+// forever for the blocked Accept. the graceful http servers set it by themselves.
+//
+// the server returns before the opened connects closed then, the caller must not
+// exit the process when it returned, the process exits by itself after the drain.
+// it returns false if "l" is not a graceful listener.
+func ReturnOnDrain(l net.Listener) bool {
+
+	var n *netListener
+	switch v := l.(type) {
+	case *netListener:
+		n = v
+	case tcpKeepAliveListener:
+		n = v.netListener
+	default:
+		return false
+	}
+	atomic.StoreInt32(&n.returnOnDrain, 1)
+	return true
 }
 
-var waitForever = make(chan struct{})
+// waitStopped covers the Accept error after the drain, see ReturnOnDrain.
+func (n *netListener) waitStopped() error {
+
+	if atomic.LoadInt32(&n.returnOnDrain) == 1 {
+		return ErrServerClosed
+	}
+	return n.m.waitStopped()
+}
 
 func (n *netListener) Accept() (net.Conn, error) {
-	closeSig.RLock()
-	if closeSig.closed {
 
-		// stop accept new connect.
-		<-waitForever
+	// stop accept new connect.
+	if n.m.isClosed() {
+		return nil, n.waitStopped()
 	}
-	closeSig.RUnlock()
 
-	c, err := n.Listener.Accept()
-	if err != nil {
+	// pace the admission of new connections.
+	if d := acceptRate.reserve(); d > 0 {
+		time.Sleep(d)
+	}
 
-		// if listener was closed, function "Accept()" will return an
-		// error:"use of closed network connection", so cover the error here.
-		closeSig.RLock()
-		if closeSig.closed {
+	// wait for a free slot, see MaxConnections.
+	waitConnSlot(n.m)
+	if n.m.isClosed() {
+		return nil, n.waitStopped()
+	}
+
+	// the accepting may be paused by ReloadInPlace.
+	waitAccept()
+
+	for {
+		c, err := n.Listener.Accept()
+		if err != nil {
+
+			// if listener was closed, function "Accept()" will return an
+			// error:"use of closed network connection", so cover the error here.
+			if n.m.isClosed() {
+				return nil, n.waitStopped()
+			}
 
-			<-waitForever
+			return nil, err
 		}
-		closeSig.RUnlock()
 
-		return nil, err
-	} else {
+		// the accepting was paused while waiting for the connection, hold it
+		// until resumed.
+		waitAccept()
 
-		waitGroup.Add(1)
-		return &netConn{Conn: c}, nil
-	}
+		// the slot is counted in activeConns, see MaxConnections.
+		if !admitConn(n.m, c, n.plainHTTP) {
+			if n.m.isClosed() {
+				return nil, n.waitStopped()
+			}
+			continue
+		}
 
+		n.m.waitGroup.Add(1)
+		atomic.AddInt64(&n.m.activeConns, 1)
+		atomic.AddInt64(&totalConns, 1)
+		return wrapConn(newNetConn(n.m, n.Addr().String(), c)), nil
+	}
 }
+
 // ListenAndServe listens on the given type network and address and then handle
 // the incoming connections.
 //
@@ -152,10 +546,18 @@ func (n *netListener) Accept() (net.Conn, error) {
 //		log.Fatal(err)
 //	}
 //
-// ListenAndServe always returns a non-nil error.
+// ListenAndServe always returns a non-nil error, ErrServerClosed after a graceful
+// stop.
 func ListenNetAndServe(net, addr string, handler func(net.Conn)) error {
 
-	listener, err := NewListener(net, addr)
+	return defaultManager.ListenNetAndServe(net, addr, handler)
+}
+
+// ListenNetAndServe acts like the package function ListenNetAndServe, the listener
+// belongs to the manager.
+func (m *Manager) ListenNetAndServe(net, addr string, handler func(net.Conn)) error {
+
+	listener, err := m.NewListener(net, addr)
 	if err != nil {
 
 		return err
@@ -175,16 +577,124 @@ func ListenNetAndServe(net, addr string, handler func(net.Conn)) error {
 	}
 }
 
+// ListenNetAndServeCtx acts like ListenNetAndServe, but the handler gets a context
+// which is cancelled when the drain of a stop or a restart begins, so a long-lived
+// connect can finish cleanly, e.g. send a goodbye or flush its buffers, instead of
+// waiting for the client to disconnect:
+//
+//	grace.ListenNetAndServeCtx("tcp", ":8081", func(ctx context.Context, c net.Conn) {
+//		go func() {
+//			<-ctx.Done()
+//			if grace.IsDraining() {
+//				io.WriteString(c, "server is restarting, please reconnect.\n")
+//				c.Close()
+//			}
+//		}()
+//		...
+//	})
+//
+// the context is also cancelled after the handler returned.
+func ListenNetAndServeCtx(network, addr string, handler func(context.Context, net.Conn)) error {
+
+	return defaultManager.ListenNetAndServeCtx(network, addr, handler)
+}
+
+// ListenNetAndServeCtx acts like the package function ListenNetAndServeCtx, the
+// listener belongs to the manager.
+func (m *Manager) ListenNetAndServeCtx(network, addr string, handler func(context.Context, net.Conn)) error {
+
+	return m.ListenNetAndServe(network, addr, func(c net.Conn) {
+
+		ctx, cancel := m.connContext(context.Background())
+		defer cancel()
+		handler(ctx, c)
+	})
+}
+
+// ListenNetAndServeContext acts like ListenNetAndServe, but the server is scoped
+// to "ctx": after "ctx" is done, the listener is closed, its socket is no longer
+// passed to the child process, and ctx.Err() is returned, the process keeps
+// running. the handlers get a context derived from "ctx", which is cancelled when
+// the drain begins too, see ListenNetAndServeCtx, e.g.:
+//
+//	ctx, cancel := context.WithCancel(context.Background())
+//	go grace.ListenNetAndServeContext(ctx, "tcp", ":8081", func(ctx context.Context, c net.Conn) {
+//		...
+//	})
+//
+//	...
+//
+//	// stop the server only
+//	cancel()
+func ListenNetAndServeContext(ctx context.Context, network, addr string, handler func(context.Context, net.Conn)) error {
+
+	return defaultManager.ListenNetAndServeContext(ctx, network, addr, handler)
+}
+
+// ListenNetAndServeContext acts like the package function ListenNetAndServeContext,
+// the listener belongs to the manager.
+func (m *Manager) ListenNetAndServeContext(ctx context.Context, network, addr string, handler func(context.Context, net.Conn)) error {
+
+	listener, err := m.NewListener(network, addr)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.releaseListener(listener, addr)
+		case <-done:
+		}
+	}()
+
+	for {
+
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			connCtx, cancel := m.connContext(ctx)
+			defer cancel()
+			handler(withConn(connCtx, conn), conn)
+		}()
+	}
+}
+
 func init() {
-	flag.BoolVar(&isChildProcess, graceTag, false, "")
-	if !flag.Parsed() {
-		flag.Parse()
+
+	// the child process is marked by the environment, so no flag is registered
+	// and the application parses its own flags.
+	isChildProcess = os.Getenv(envChild) == "1"
+
+	// a parent process of the old versions marks the child process by the flag,
+	// remove it before the application parses the flags.
+	if len(os.Args) > 1 && os.Args[1] == "-"+graceTag {
+		isChildProcess = true
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
 	}
+	initialArgs = append([]string{}, os.Args[1:]...)
 
 	if isChildProcess {
-		logf("initializing...\n")
+		parentPID, _ = strconv.Atoi(os.Getenv(envParentPID))
+		generation, _ = strconv.Atoi(os.Getenv(envGeneration))
+		logf("initializing... parent process: %d\n", parentPID)
 	}
 
+	// the processes started by the application are not graceful children.
+	os.Unsetenv(envChild)
+	os.Unsetenv(envParentPID)
+	os.Unsetenv(envGeneration)
+
 	switch runtime.GOOS {
 	case "windows":
 		osSupportSocketFile = false
@@ -196,54 +706,155 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	testhook.Reset = resetRestartState
 }
 
-func startNewProcess() error {
+// resetRestartState lets the process restart again after a simulated restart, see
+// gracetest.
+func resetRestartState() {
 
-	logf("starting new process...\n")
-	args := os.Args
-	path, err := filepath.Abs(args[0])
-	if err != nil {
-		return err
+	atomic.StoreInt32(&restarting, 0)
+	atomic.StoreInt32(&failedRestarts, 0)
+	atomic.StoreInt64(&lastRestart, 0)
+	pendingRestart.Store((*RestartResult)(nil))
+}
+
+// ParentPID returns the pid of the process which started the current process by
+// a graceful restart, returns 0 if the current process is the first process.
+func ParentPID() int {
+
+	return parentPID
+}
+
+// startNewProcess starts the child process with the options of the restart, "env"
+// are the extra env vars of the child process.
+func startNewProcess(opts restartOptions, env ...string) (*os.Process, error) {
+
+	// simulated by gracetest.
+	if start := testhook.Start(); start != nil {
+		return start()
 	}
-	// replace first arg(like "./main") with "-graceful"
-	if !isChildProcess {
-		args[0] = "-" + graceTag
-	} else {
-		args = args[1:]
+
+	logf("starting new process...\n")
+	path := opts.path
+	var err error
+	if path == "" {
+		path, err = execPath()
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	args := childArgs(opts)
+
 	var pipeReader, pipeWriter *os.File
 
-	if osSupportSocketFile {
+	usePipe := osSupportSocketFile && handoffMode == HandoffPipe
+	if usePipe {
 		pipeReader, pipeWriter, err = os.Pipe()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	cmd := exec.Command(path, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	childEnv := append(
+		append(os.Environ(), restartEnvVars()...),
+		envChild+"=1",
+		fmt.Sprintf("%s=%d", envRestartCount, generation+1),
+		fmt.Sprintf("%s=%d", envParentPID, pid),
+		fmt.Sprintf("%s=%d", envGeneration, generation+1),
+	)
+	childEnv = append(childEnv, env...)
+
+	var files []*os.File
+	var socketIndex map[string]uintptr
+	if usePipe {
+		socketLock.Lock()
+		files = append([]*os.File{pipeReader}, socketFiles...)
+
+		// fd 3 is the pipe reader.
+		socketIndex = extraFileIndex(files)
+		socketLock.Unlock()
+	} else if osSupportSocketFile {
+		socketLock.Lock()
+
+		// socket files start from fd 3.
+		files = append([]*os.File{}, socketFiles...)
+		childEnv = append(childEnv, handoffEnv()...)
+		socketLock.Unlock()
+	}
 
-	if osSupportSocketFile {
-		cmd.ExtraFiles = append([]*os.File{pipeReader}, socketFiles...)
+	// the child process reports ready by the last extra file.
+	var readyReader, readyWriter *os.File
+	if osSupportSocketFile && readyTimeout > 0 {
+		readyReader, readyWriter, err = os.Pipe()
+		if err != nil {
+			if usePipe {
+				pipeReader.Close()
+				pipeWriter.Close()
+			}
+			return nil, err
+		}
+		childEnv = append(childEnv, fmt.Sprintf("%s=%d", envReadyFD, 3+len(files)))
+		files = append(files, readyWriter)
 	}
 
-	err = cmd.Start()
+	p, err := getSpawner().Spawn(path, args, dedupEnv(childEnv), files)
+	if usePipe {
+		pipeReader.Close()
+		defer pipeWriter.Close()
+	}
+	if readyWriter != nil {
+		readyWriter.Close()
+	}
 	if err != nil {
-		return err
+		if readyReader != nil {
+			readyReader.Close()
+		}
+		return nil, err
 	}
 
-	if osSupportSocketFile {
-		return json.NewEncoder(pipeWriter).Encode(socketIndex)
+	// the current process may live on, e.g. the restart failed.
+	exited := reapProcess(p)
+
+	if usePipe {
+		err = json.NewEncoder(pipeWriter).Encode(socketIndex)
+		if err != nil {
+			if readyReader != nil {
+				readyReader.Close()
+			}
+			return p, err
+		}
 	}
-	return nil
+
+	if readyReader != nil {
+
+		// keep serving until the child process is ready.
+		err = waitReady(readyReader, p, exited)
+	}
+	return p, err
 }
 
 func initSocketFiles() error {
 
+	if osSupportSocketFile && isChildProcess {
+		initReadyPipe()
+	}
+
+	// started by systemd socket activation.
+	if osSupportSocketFile && !isChildProcess && inheritSystemdSockets() {
+		return nil
+	}
+
+	if osSupportSocketFile && isChildProcess && os.Getenv(envListenFDs) != "" {
+		return inheritEnvSocketFiles()
+	}
+
+	if !osSupportSocketFile && isChildProcess {
+		initRebind()
+	}
+
 	if osSupportSocketFile {
 
 		// read socket files information from the first extra file.
@@ -252,41 +863,70 @@ func initSocketFiles() error {
 
 		if isChildProcess {
 
+			var socketIndex map[string]uintptr
 			err := json.NewDecoder(pipeReader).Decode(&socketIndex)
 			if err != nil {
 				return err
 			}
 
 			// get all socket files from parent process.
-			for name, idx := range socketIndex {
-				f := os.NewFile(idx, name)
-				socketFiles = append(socketFiles, f)
-			}
+			inheritSocketFiles(socketIndex)
 		}
 	}
 	return nil
 }
 
 // NewListener returns a graceful net listener
+//
+// the child process matches the inherited sockets by the exact "addr" string, the
+// address is never normalized, so a socket bound to a specific interface(e.g.
+// "192.168.1.5:8080") keeps its binding across restarts, and the same "addr" must
+// be used by both the parent and the child process.
+//
+// on Linux, a "unix" address starting with "@" is an abstract socket(e.g.
+// "@myapp.sock"), it has no file on disk, so nothing needs to be unlinked across
+// restarts, and the child process matches it by the same "@" form.
+//
+// in the child process, the sockets inherited from the parent process but not
+// used by NewListener within one minute will be closed, so the sockets of removed
+// addresses won't leak, see SetInheritGracePeriod for the listeners created lazily.
 func NewListener(netType, addr string) (l net.Listener, err error) {
 
+	return defaultManager.NewListener(netType, addr)
+}
+
+// NewListener acts like the package function NewListener, the listener belongs to
+// the manager, it's closed by the manager's Drain or Stop. the addresses are shared
+// by the process, an address can't be used by more than one manager.
+func (m *Manager) NewListener(netType, addr string) (l net.Listener, err error) {
+
 	if osSupportSocketFile {
 
 		// handle as child process
-		for _, f := range socketFiles {
-			if f.Name() == addr {
-				l, err = net.FileListener(f)
-				if err != nil {
-					return nil, err
-				}
-				l = &netListener{Listener: l}
-				listeners = append(listeners, l)
-				return
+		if f := claimSocketFile(addr); f != nil {
+			l, err = net.FileListener(f)
+			if err != nil {
+				return nil, err
 			}
+			verifyUnixPerm(netType, addr)
+			l = &netListener{Listener: l, m: m, unixPath: unixSocketPath(netType, addr)}
+			m.appendListener(l)
+			return
+		}
+
+		unixPath := unixSocketPath(netType, addr)
+		if unixPath != "" {
+			removeStaleUnixSocket(netType, unixPath)
 		}
 
-		l, err = net.Listen(netType, addr)
+		l, err = listen(netType, addr)
 		if err != nil {
+			return nil, listenError(netType, addr, err)
+		}
+		keepUnixSocket(l)
+
+		if err = applyUnixPerm(netType, addr); err != nil {
+			l.Close()
 			return nil, err
 		}
 
@@ -297,92 +937,489 @@ func NewListener(netType, addr string) (l net.Listener, err error) {
 				return nil, err
 			}
 
-			// record socket file's "name" & "Fd".
-			socketIndex[addr] = uintptr(len(socketFiles) + 4)
-
 			// store socket files
-			socketFiles = append(socketFiles, f)
+			addSocketFile(addr, f)
 		}
 
-		l = &netListener{Listener: l}
-		listeners = append(listeners, l)
+		l = &netListener{Listener: l, m: m, unixPath: unixPath}
+		m.appendListener(l)
 
 		return l, err
 
 	} else {
 
-		return net.Listen(netType, addr)
+		l, err = listen(netType, addr)
+		if err != nil {
+			return nil, listenError(netType, addr, err)
+		}
+
+		if err = applyUnixPerm(netType, addr); err != nil {
+			l.Close()
+			return nil, err
+		}
+
+		rebound(addr)
+		l = &netListener{Listener: l, m: m}
+		m.appendListener(l)
+		return l, nil
 	}
 }
 
-// Restart starts a new process with the same executable file, and wait to exit until
-// all opened connects closed.
-func Restart() {
+// WrapListener makes a listener created by the caller graceful, e.g. a listener with
+// custom socket options. the listener belongs to the manager and its socket is
+// passed to the child process on restart, keyed by the listener's address.
+//
+// the child process creates its own listener before calling WrapListener, the
+// bind only succeeds if the socket allows it(e.g. SO_REUSEPORT), then the inherited
+// socket takes over and the new listener is closed, so the queued connects are not
+// lost.
+func (m *Manager) WrapListener(l net.Listener) (net.Listener, error) {
 
-	if osSupportSocketFile {
+	return m.wrapListener(l)
+}
 
-		err := startNewProcess()
+func (m *Manager) wrapListener(l net.Listener) (*netListener, error) {
+
+	addr := l.Addr()
+	key := addr.String()
+	if !osSupportSocketFile {
+		rebound(key)
+		n := &netListener{Listener: l, m: m}
+		m.appendListener(n)
+		return n, nil
+	}
+
+	unixPath := unixSocketPath(addr.Network(), key)
+
+	// handle as child process
+	if f := claimSocketFile(key); f != nil {
+		inherited, err := net.FileListener(f)
 		if err != nil {
-			logf("start new process failed! %v\n", err)
-			// if new process got any error, current process should continue to serve.
-			// so prevent to stop the process.
-			return
+			return nil, err
 		}
 
-		Stop()
+		// the socket file belongs to the inherited socket.
+		keepUnixSocket(l)
+		l.Close()
+
+		n := &netListener{Listener: inherited, m: m, unixPath: unixPath}
+		m.appendListener(n)
+		return n, nil
+	}
+
+	// handle as parent process
+	keepUnixSocket(l)
+	if sf, ok := l.(supportSocketFile); ok {
+		f, err := sf.File()
+		if err != nil {
+			return nil, err
+		}
+		addSocketFile(key, f)
+	}
+
+	n := &netListener{Listener: l, m: m, unixPath: unixPath}
+	m.appendListener(n)
+	return n, nil
+}
+
+// Restart starts a new process with the same executable file, and wait to exit until
+// all opened connects closed. Restart only returns if the restart failed, e.g.:
+//
+//	if err := grace.Restart(); err != nil {
+//		log.Printf("restart failed: %v", err)
+//	}
+//
+// if the new process failed to start, the current process continues to serve. on
+// the platforms which rebind the addresses(windows), the listeners are open until
+// the new process bound all of them, the start is retried a few times with backoff
+// if the bind failed.
+//
+// only one restart is in progress at a time, the calls during it(e.g. a signal
+// arrives while a file event is pending) return ErrRestartInProgress without
+// starting another process.
+func Restart() error {
+
+	return defaultManager.Restart()
+}
+
+// ErrRestartInProgress is returned by Restart if another restart is in progress,
+// only one new process is started.
+var ErrRestartInProgress = errors.New("grace: a restart is in progress")
+
+// Restart acts like the package function Restart, the new process is started for
+// the whole process, then the manager stops, see Manager.Stop.
+func (m *Manager) Restart() error {
+
+	return m.restart(restartOptions{})
+}
+
+// restart starts the new process with the options of this restart, see Restart.
+func (m *Manager) restart(opts restartOptions) error {
+
+	// only one restart is in progress, a signal, the file watcher and the
+	// application may restart at the same time.
+	if !atomic.CompareAndSwapInt32(&restarting, 0, 1) {
+		return ErrRestartInProgress
+	}
+
+	// a stop waits until the child process started, see Drain.
+	m.lifecycle.Lock()
+	if m.isClosed() {
+		m.lifecycle.Unlock()
+		atomic.StoreInt32(&restarting, 0)
+		return errors.New("grace: the process is stopping")
+	}
+
+	release, err := acquireRestartLock()
+	if err != nil {
+		m.lifecycle.Unlock()
+		atomic.StoreInt32(&restarting, 0)
+		logf("acquire restart lock failed! %v\n", err)
+		return err
+	}
+
+	var p *os.Process
+	if osSupportSocketFile {
+		p, err = startNewProcess(opts)
 	} else {
 
-		// because must close all net listeners before the new process started. (or will
-		// cause the addr already in use error) so if startNewProcess() returns any error,
-		// it's too late to handle it.
-		BeforeCloseCall(func() {
-			err := startNewProcess()
-			if err != nil {
-				logf("start new process failed! %v\n", err)
-			}
+		// the new process binds the addresses before the listeners closed.
+		p, err = startRetry(func() (*os.Process, error) {
+			return startRebindProcess(opts)
 		})
+	}
+	release()
+	m.lifecycle.Unlock()
+
+	result := newRestartResult(p, err)
+	metricsRestarted(err)
+	if err != nil {
+		atomic.StoreInt32(&restarting, 0)
+		atomic.AddInt32(&failedRestarts, 1)
+		atomic.StoreInt64(&lastRestart, time.Now().UnixNano())
+		logf("start new process failed! %v\n", err)
+		writeRestartLog(result)
+		// if new process got any error, current process should continue to serve.
+		// so prevent to stop the process.
+		return err
+	}
+
+	atomic.StoreInt32(&failedRestarts, 0)
+	pendingRestart.Store(result)
+	emit(PhaseChildStarted, p.Pid)
+	m.Stop()
+	return nil
+}
 
-		Stop()
+const (
+	// attempts of starting the new process.
+	startRetries = 3
+
+	// delay before the first retry, doubled per retry.
+	startRetryDelay = 200 * time.Millisecond
+)
+
+// startRetry starts the new process by "start", retries with backoff if it
+// failed, e.g. the new process can't bind the addresses while the sockets of a
+// previous process are still in TIME_WAIT.
+func startRetry(start func() (*os.Process, error)) (p *os.Process, err error) {
+
+	delay := startRetryDelay
+	for i := 0; ; i++ {
+		p, err = start()
+		if err == nil || i == startRetries-1 {
+			return
+		}
+		logf("start new process failed, retry in %s: %v\n", delay, err)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
 
 // Stop will exited the process after all opened connects closed.
 func Stop() {
 
-	// stop accept new connect.
-	closeSig.Lock()
-	closeSig.closed = true
-	closeSig.Unlock()
+	defaultManager.Stop()
+}
 
-	// run before callbacks
-	for _, c := range beforeCloseCalls {
+// Stop will exited the process after all opened connects of the manager closed,
+// use StopGraceful to stop the manager only.
+func (m *Manager) Stop() {
 
-		c()
-	}
+	m.stop(0)
+}
 
-	logf("wait for close...\n")
+// isClosed reports whether the process stopped accepting new connects.
+func isClosed() bool {
 
-	// close all listeners.
-	for _, l := range listeners {
+	return defaultManager.isClosed()
+}
 
-		l.Close()
-	}
+// isClosed reports whether the manager stopped accepting new connects.
+func (m *Manager) isClosed() bool {
 
-	// wait until all connect closed.
-	waitGroup.Wait()
+	m.closeSig.RLock()
+	defer m.closeSig.RUnlock()
+	return m.closeSig.closed
+}
 
-	// run after callbacks
-	for _, c := range afterCloseCalls {
+// quitDrainTimeout is the drain timeout of signal "syscall.SIGQUIT".
+const quitDrainTimeout = 5 * time.Second
 
-		c()
-	}
+// StopGraceful does the same as Stop, stops accepting new connects, runs the
+// BeforeCloseCall callbacks, closes the listeners, waits for all opened connects
+// closed, runs the AfterCloseCall callbacks and the flushers, but returns to the
+// caller instead of exiting the process, e.g. in tests or for the applications
+// which run their own final cleanup. it returns the first error returned by the
+// AfterCloseCall callbacks or the flushers. calling it more than once waits for
+// the first call and returns the same error.
+func StopGraceful() error {
+
+	return defaultManager.StopGraceful()
+}
+
+// StopGraceful acts like the package function StopGraceful, the other managers
+// keep serving.
+func (m *Manager) StopGraceful() error {
+
+	defer m.closeStopped()
+	return m.shutdown(0, false)
+}
+
+// StopWithTimeout does the same as StopGraceful, but waits at most "d" for the
+// opened connects, e.g. long-polls or stuck readers, the remaining connects will be
+// closed forcibly and an error reporting the number of them is returned.
+func StopWithTimeout(d time.Duration) error {
 
+	return defaultManager.StopWithTimeout(d)
+}
+
+// StopWithTimeout acts like the package function StopWithTimeout.
+func (m *Manager) StopWithTimeout(d time.Duration) error {
+
+	defer m.closeStopped()
+	return m.shutdown(d, true)
+}
+
+// stop exits the process after all opened connects closed, if "timeout" is
+// greater than 0, stop waits at most "timeout" for the connects, the remaining
+// connects will be cut off by the exit.
+func (m *Manager) stop(timeout time.Duration) {
+
+	m.shutdown(timeout, false)
+	emit(PhaseExiting, 0)
 	logf("exited!\n")
+
+	// simulated by gracetest, the process keeps running.
+	if exit := testhook.Exit(); exit != nil {
+		exit(0)
+		m.closeStopped()
+		return
+	}
+
 	// exit current process.
 	os.Exit(0)
 }
 
-var once = &sync.Once{}
+// shutdown stops the process without exiting, see stop. if "force" is true, the
+// connects remaining after "timeout" are closed.
+func (m *Manager) shutdown(timeout time.Duration, force bool) error {
+
+	m.shutdownOnce.Do(func() {
+
+		start := time.Now()
+		if timeout > 0 {
+			m.setDrainDeadline(start.Add(timeout))
+		}
+
+		m.Drain()
+
+		// wait until all connect closed.
+		if !m.waitConns(timeout) && force {
+			if n := closeConns(m); n > 0 {
+				logf("force closed %d connects.\n", n)
+				m.shutdownErr = fmt.Errorf("grace: force closed %d connects after %s", n, timeout)
+			}
+		}
+		emit(PhaseDrained, 0)
+		drain := time.Since(start)
+		metricsDrained(drain)
+
+		if result, ok := pendingRestart.Load().(*RestartResult); ok && result != nil {
+			result.DrainDuration = drain
+			writeRestartLog(result)
+		}
+
+		// run after callbacks
+		_, afterCalls, _ := m.closeCalls()
+		logf("running %d after close callbacks...\n", len(afterCalls))
+		ctx, cancel := m.closeContext()
+		reason := closeReason()
+		for i, c := range afterCalls {
+
+			err := runCallback(func() error {
+				return c(ctx, reason)
+			})
+			if err != nil {
+				logf("after close callback %d failed! %v\n", i, err)
+				if m.shutdownErr == nil {
+					m.shutdownErr = err
+				}
+			}
+		}
+
+		cancel()
+
+		// flush buffered data, e.g. telemetry.
+		if err := runFlushers(); err != nil && m.shutdownErr == nil {
+			m.shutdownErr = err
+		}
+
+		logSummary(drain)
+	})
+	return m.shutdownErr
+}
+
+// Drain stops accepting new connects, runs the BeforeCloseCall callbacks and closes
+// all listeners, unlike Stop, it returns immediately without waiting for the opened
+// connects or exiting the process, see WaitDrain. calling Drain more than once has
+// no effect.
+func Drain() {
+
+	defaultManager.Drain()
+}
+
+// Drain acts like the package function Drain, only the listeners of the manager
+// are closed.
+func (m *Manager) Drain() {
+
+	m.drainOnce.Do(func() {
+
+		// stop accept new connect, after the child process of a restart in
+		// progress started, the restarts from now on fail.
+		m.lifecycle.Lock()
+		m.closeSig.Lock()
+		m.closeSig.closed = true
+		m.closeSig.Unlock()
+		m.lifecycle.Unlock()
+
+		// the Accept calls queued by MaxConnections return.
+		wakeConnSlots()
+
+		// let the connect handlers finish, see ListenNetAndServeCtx.
+		m.drainCancel()
+		emit(PhaseDraining, 0)
+
+		beforeCalls, _, listeners := m.closeCalls()
+
+		// run before callbacks
+		ctx, cancel := m.closeContext()
+		reason := closeReason()
+		for i, c := range beforeCalls {
+
+			err := runCallback(func() error {
+				c(ctx, reason)
+				return nil
+			})
+			if err != nil {
+				logf("before close callback %d failed! %v\n", i, err)
+			}
+		}
+		cancel()
+
+		logf("wait for close...\n")
+
+		// close all listeners.
+		for _, l := range listeners {
+
+			l.Close()
+		}
+		m.closePacketConns()
+		emit(PhaseListenersClosed, 0)
+
+		drainIdleConns(m)
+		notifyDrainConns(m)
+	})
+}
+
+// WaitDrain waits at most "timeout" for all opened connects closed after Drain,
+// it reports whether the connects were all closed, and the number of the remaining
+// connects. e.g. a deploy script:
+//
+//	grace.Drain()
+//	if ok, remaining := grace.WaitDrain(30 * time.Second); !ok {
+//		log.Printf("%d connects are still opened", remaining)
+//	}
+//
+// a "timeout" less than or equal to 0 means waiting without timeout.
+func WaitDrain(timeout time.Duration) (completed bool, remaining int) {
+
+	return defaultManager.WaitDrain(timeout)
+}
+
+// WaitDrain acts like the package function WaitDrain, it waits for the connects
+// of the manager.
+func (m *Manager) WaitDrain(timeout time.Duration) (completed bool, remaining int) {
+
+	if m.waitConns(timeout) {
+		return true, 0
+	}
+	return false, int(atomic.LoadInt64(&m.activeConns))
+}
+
+// waitConns waits at most "timeout" for all opened connects closed, it reports
+// whether the connects were all closed.
+func (m *Manager) waitConns(timeout time.Duration) bool {
+
+	if timeout <= 0 {
+		m.waitGroup.Wait()
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		logf("drain timeout after %s.\n", timeout)
+		return false
+	}
+}
+
+// ignoreTerminalHangup reports whether the signal "syscall.SIGHUP" is ignored when
+// the process runs in a terminal.
+var ignoreTerminalHangup bool
+
+// IgnoreTerminalHangup makes ListenSignal ignore the signal "syscall.SIGHUP" when
+// the standard input is a terminal, so closing the terminal(e.g. a disconnected
+// ssh session) doesn't restart the server. use command "kill -HUP $pid" from
+// another terminal won't work either in this case, use Restart() instead.
+//
+// alternatively, detach the process from the terminal by "setsid", or redirect
+// the standard input from "/dev/null". note that "nohup" doesn't work, because
+// ListenSignal re-enables the ignored signal.
+func IgnoreTerminalHangup(ignore bool) {
+
+	ignoreTerminalHangup = ignore
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	// "/dev/null" is a character device too.
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
 
 // ListenSignal listens system signals and watches the executable file events.
 // it will automatically restart the server when it got signal or file event.
@@ -394,77 +1431,98 @@ var once = &sync.Once{}
 // when process got signal "syscall.SIGINT" or signal "syscall.SIGTERM", the process
 // will wait to exit until all opened connects closed.
 //
+// when process got signal "syscall.SIGQUIT", the process will wait at most 5 seconds
+// for the opened connects, then run the AfterCloseCall callbacks and exit. it's a
+// "hurry up" stop, note that the signal no longer makes the process dump stacks
+// like the Go runtime does by default.
+//
 // when the executable file trigger event "fsnotify.Chmod"(e.g. when rebuild a project,
 // this will generate a new executable file and trigger the event), the old process
 // will use the new executable file to start a new child process, and wait to exit
-// until all opened connects closed.
+// until all opened connects closed. see WatchDirectory for deploys which swap a
+// directory symlink instead of the executable file.
 //
 // listen signal is an custom option, some times if we need to restart or stop server
 // manually, we can use the method Restart() or Stop() directly.
 func ListenSignal() {
 
-	once.Do(func() {
+	defaultManager.ListenSignal()
+}
 
-		// listen signals.
-		signalChan := make(chan os.Signal)
+// ListenSignalWith acts like ListenSignal, but the signals "restart" restart the
+// process and the signals "stop" stop the process, e.g. reload on "syscall.SIGUSR2"
+// and leave "syscall.SIGHUP" to the application:
+//
+//	grace.ListenSignalWith(
+//		[]os.Signal{syscall.SIGUSR2},
+//		[]os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT},
+//	)
+//
+// "syscall.SIGQUIT" in "stop" is still a "hurry up" stop. only the first call of
+// ListenSignal or ListenSignalWith takes effect.
+func ListenSignalWith(restart, stop []os.Signal) {
 
-		signal.Notify(
-			signalChan,
-			syscall.SIGTERM,
-			syscall.SIGHUP,
-			syscall.SIGINT,
-		)
+	defaultManager.ListenSignalWith(restart, stop)
+}
 
-		go func() {
-			sig := <-signalChan
-			switch sig {
-			case syscall.SIGHUP:
-				Restart()
-			case syscall.SIGTERM, syscall.SIGINT:
-				Stop()
-			}
-		}()
+// ListenSignal acts like the package function ListenSignal, the signals and the
+// file events restart or stop the process through the manager. the signals are
+// sent to the whole process, so only one manager should listen them.
+func (m *Manager) ListenSignal() {
 
-		// listen file event.
-		watcher, err := fsnotify.NewWatcher()
-		if err != nil {
-			log.Printf("grace.ListenSignal(): %v\n", err)
-			return
-		}
+	m.ListenSignalWith(
+		[]os.Signal{syscall.SIGHUP},
+		[]os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT},
+	)
+}
 
-		BeforeCloseCall(func() {
+// ListenSignalWith acts like the package function ListenSignalWith.
+func (m *Manager) ListenSignalWith(restart, stop []os.Signal) {
 
-			watcher.Close()
-		})
+	m.signalOnce.Do(func() {
+
+		// listen signals.
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, append(append([]os.Signal{}, restart...), stop...)...)
 
-		timer := time.NewTimer(0)
-		<-timer.C
 		go func() {
 
-			for {
-				select {
-				case evt := <-watcher.Events:
-
-					switch evt.Op {
-					case fsnotify.Chmod, fsnotify.Write:
-						timer.Reset(time.Second)
-					}
-				case err := <-watcher.Errors:
-					if err != nil {
-						log.Printf("grace.ListenSignal(): %v\n", err)
-					}
+			// keep listening, a failed restart returns and the process
+			// continues to serve.
+			for sig := range signalChan {
+				if sig == syscall.SIGHUP && ignoreTerminalHangup && isTerminal(os.Stdin) {
+					logf("ignored signal %s from the terminal.\n", sig)
+					continue
+				}
+
+				setExitReason("signal: " + sig.String())
+				switch {
+				case signalContains(restart, sig):
+					m.Restart()
+				case sig == syscall.SIGQUIT:
+					m.stop(quitDrainTimeout)
+				default:
+					m.Stop()
 				}
 			}
 		}()
 
-		go func() {
-			<-timer.C
-			Restart()
-		}()
+		if !watchExe && len(extraFiles.paths) == 0 {
+			return
+		}
 
-		err = watcher.Add(os.Args[0])
-		if err != nil {
-			log.Printf("grace.ListenSignal(): %v\n", err)
+		// listen file event, signals still work if the file watcher failed.
+		if err := watchExecutable(m); err != nil {
+			logf("grace.ListenSignal(): %v\n", err)
 		}
 	})
 }
+
+func signalContains(sigs []os.Signal, sig os.Signal) bool {
+	for _, s := range sigs {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,287 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"net"
+	"sync"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
+)
+
+// acceptOne dials the listener and returns the accepted connect and the client.
+func acceptOne(t *testing.T, l net.Listener) (net.Conn, net.Conn) {
+
+	client, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, client
+}
+
+func TestConnCloseTwice(t *testing.T) {
+
+	m := newTestManager(t)
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ := acceptOne(t, l)
+	if n := atomic.LoadInt64(&m.activeConns); n != 1 {
+		t.Fatalf("active connects: %d, want 1", n)
+	}
+
+	// e.g. by the handler and by the deferred Close of ListenNetAndServe, a
+	// second release would panic with a negative WaitGroup counter.
+	c.Close()
+	c.Close()
+
+	if n := atomic.LoadInt64(&m.activeConns); n != 0 {
+		t.Fatalf("active connects: %d, want 0", n)
+	}
+	if ok, remaining := m.WaitDrain(time.Second); !ok {
+		t.Fatalf("%d connects remaining", remaining)
+	}
+}
+
+// a blocked Accept returns ErrServerClosed when the manager stops.
+func TestAcceptStopGraceful(t *testing.T) {
+
+	for _, returnOnDrain := range []bool{false, true} {
+		m := newTestManager(t)
+		l, err := m.NewListener("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if returnOnDrain {
+			ReturnOnDrain(l)
+		}
+
+		accepted := make(chan error, 1)
+		go func() {
+			_, err := l.Accept()
+			accepted <- err
+		}()
+
+		// let the Accept block.
+		select {
+		case err := <-accepted:
+			t.Fatalf("ReturnOnDrain %v: Accept returned before the stop: %v", returnOnDrain, err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		m.StopGraceful()
+		select {
+		case err := <-accepted:
+			if err != ErrServerClosed {
+				t.Fatalf("ReturnOnDrain %v: got %v, want ErrServerClosed", returnOnDrain, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("ReturnOnDrain %v: Accept is still blocked after the stop", returnOnDrain)
+		}
+	}
+}
+
+func TestRegisterCallbacksConcurrently(t *testing.T) {
+
+	m := newTestManager(t)
+
+	// run with -race.
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			BeforeCloseCall(func() {})
+			m.BeforeCloseCall(func() {})
+			m.AfterCloseCall(func() {})
+			PrepareRestart(func() error { return nil })
+			BeforeReloadCall(func() error { return nil })
+		}()
+	}
+	wg.Wait()
+
+	before, after, _ := m.closeCalls()
+	if len(before) != n || len(after) != n {
+		t.Fatalf("%d before close callbacks and %d after close callbacks, want %d", len(before), len(after), n)
+	}
+}
+
+// rebindRestart makes the restarts of the test rebind the addresses like on
+// windows, "start" simulates the new process.
+func rebindRestart(t *testing.T, start func() (*os.Process, error)) {
+
+	osSupportSocketFile = false
+	testhook.SetStart(start)
+	testhook.SetExit(func(int) {})
+	t.Cleanup(func() {
+		osSupportSocketFile = runtime.GOOS != "windows"
+		testhook.SetStart(nil)
+		testhook.SetExit(nil)
+		resetRestartState()
+	})
+}
+
+func TestRestartRetriesBind(t *testing.T) {
+
+	// the new process can't bind the addresses twice, e.g. in TIME_WAIT.
+	errBind := errors.New("bind: address already in use")
+	starts := 0
+	rebindRestart(t, func() (*os.Process, error) {
+		starts++
+		if starts < 3 {
+			return nil, errBind
+		}
+		return &os.Process{Pid: 1<<31 - 1}, nil
+	})
+
+	m := newTestManager(t)
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if starts != 3 {
+		t.Fatalf("started %d times, want 3", starts)
+	}
+}
+
+func TestRestartBindFailed(t *testing.T) {
+
+	errBind := errors.New("bind: address already in use")
+	starts := 0
+	rebindRestart(t, func() (*os.Process, error) {
+		starts++
+		return nil, errBind
+	})
+
+	m := newTestManager(t)
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Restart(); err != errBind {
+		t.Fatalf("Restart() = %v, want %v", err, errBind)
+	}
+	if starts != startRetries {
+		t.Fatalf("started %d times, want %d", starts, startRetries)
+	}
+
+	// the current process keeps serving.
+	c, _ := acceptOne(t, l)
+	c.Close()
+}
+
+// a stop waits for the child process of a restart in progress, a restart after
+// the stop began fails without starting the child process.
+func TestRestartRacingStop(t *testing.T) {
+
+	m := newTestManager(t)
+	if _, err := m.NewListener("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var starts int32
+	entered := make(chan struct{})
+	proceed := make(chan struct{})
+	testhook.SetStart(func() (*os.Process, error) {
+		if atomic.AddInt32(&starts, 1) == 1 {
+			close(entered)
+			<-proceed
+		}
+		return &os.Process{Pid: 1<<31 - 1}, nil
+	})
+	testhook.SetExit(func(int) {})
+	t.Cleanup(func() {
+		testhook.SetStart(nil)
+		testhook.SetExit(nil)
+		resetRestartState()
+	})
+
+	restarted := make(chan error, 1)
+	go func() {
+		restarted <- m.Restart()
+	}()
+	<-entered
+
+	stopped := make(chan struct{})
+	go func() {
+		m.StopGraceful()
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if m.isClosed() {
+		t.Fatal("the drain began while the child process was starting")
+	}
+	close(proceed)
+
+	if err := <-restarted; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stop is blocked after the child process started")
+	}
+
+	// the stop won.
+	resetRestartState()
+	if err := m.Restart(); err == nil {
+		t.Fatal("restarted a stopped manager")
+	}
+	if n := atomic.LoadInt32(&starts); n != 1 {
+		t.Fatalf("started %d child processes, want 1", n)
+	}
+}
+
+// the read deadline of the application is kept by the idle timeout, and its
+// timeout doesn't close the connect.
+func TestConnIdleTimeoutReadDeadline(t *testing.T) {
+
+	ConnIdleTimeout(time.Second)
+	defer ConnIdleTimeout(0)
+
+	m := newTestManager(t)
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, client := acceptOne(t, l)
+	defer c.Close()
+
+	start := time.Now()
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("the read deadline is replaced by the idle timeout, timed out after %s", d)
+	}
+
+	// the connect is still usable.
+	c.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("the connect is closed by the read deadline: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"context"
+	"time"
+)
+
+// RestartLocker is a distributed lock(e.g. implemented by etcd or redis), which
+// limits how many instances of a cluster restart at the same time, so rolling
+// restarts won't take down too many nodes at once.
+type RestartLocker interface {
+
+	// Acquire blocks until the lock is acquired or the context is done.
+	Acquire(ctx context.Context) error
+
+	// Release releases the acquired lock.
+	Release()
+}
+
+var (
+	restartLocker RestartLocker
+
+	restartLockTimeout time.Duration
+)
+
+// SetRestartLocker sets the locker used by Restart, Restart acquires the lock
+// before starting the new process and gives up if the lock can't be acquired
+// within "timeout"(0 means no timeout), the lock is released after the new process
+// started or failed to start. nil removes the locker.
+func SetRestartLocker(l RestartLocker, timeout time.Duration) {
+
+	restartLocker = l
+	restartLockTimeout = timeout
+}
+
+// acquireRestartLock acquires the restart lock if the locker is set, it returns
+// the function to release the lock.
+func acquireRestartLock() (release func(), err error) {
+
+	l := restartLocker
+	if l == nil {
+		return func() {}, nil
+	}
+
+	ctx := context.Background()
+	if restartLockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, restartLockTimeout)
+		defer cancel()
+	}
+
+	if err := l.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	return l.Release, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"fmt"
+	"sync/atomic"
+	"gopkg.in/orivil/log.v0"
+)
+
+// Logger logs the messages of the package, e.g. an adapter of slog, zap or logrus:
+//
+//	type slogLogger struct{}
+//
+//	func (slogLogger) Printf(format string, args ...interface{}) {
+//		slog.Info(fmt.Sprintf(format, args...))
+//	}
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// loggerHolder keeps the same concrete type in the atomic.Value.
+type loggerHolder struct {
+	Logger
+}
+
+// stores the loggerHolder, it's set before the init functions which may log.
+var logger = func() *atomic.Value {
+
+	v := &atomic.Value{}
+	v.Store(loggerHolder{orivilLogger{}})
+	return v
+}()
+
+// SetLogger sets the logger of the package, the messages are prefixed with the
+// pid of the process. nil restores the default logger, which is
+// "gopkg.in/orivil/log.v0".
+func SetLogger(l Logger) {
+
+	if l == nil {
+		l = orivilLogger{}
+	}
+	logger.Store(loggerHolder{l})
+}
+
+type orivilLogger struct{}
+
+func (orivilLogger) Printf(format string, args ...interface{}) {
+
+	log.Printf(format, args...)
+}
+
+func logf(format string, args ...interface{}) {
+
+	logger.Load().(loggerHolder).Printf(fmt.Sprintf("[process: %d] ", pid)+format, args...)
+}
@@ -0,0 +1,278 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"testing"
+	"runtime"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
+)
+
+// the test binary runs as a helper process instead of the tests if the env var is
+// set, e.g. as the child process of a real restart, see runChild.
+const envTestHelper = "GRACE_TEST_HELPER"
+
+const (
+	// path prefix of the reports written by the helper processes.
+	envTestReport = "GRACE_TEST_REPORT"
+
+	// comma-separated "network|addr" the child process listens on.
+	envTestListen = "GRACE_TEST_LISTEN"
+
+	// the child process restarts itself until the generation.
+	envTestGenerations = "GRACE_TEST_GENERATIONS"
+
+	// working directory of the watcher process.
+	envTestDir = "GRACE_TEST_DIR"
+)
+
+func TestMain(m *testing.M) {
+
+	switch os.Getenv(envTestHelper) {
+	case "child":
+		os.Exit(runChild())
+	case "watcher":
+		os.Exit(runWatcher())
+	}
+	os.Exit(m.Run())
+}
+
+// childReport is written by the child process of a real restart.
+type childReport struct {
+	Generation int
+	Args       []string
+
+	// the executable file of the process.
+	Executable string
+
+	// addresses of the inherited sockets.
+	Inherited []string
+
+	// bound addresses keyed by the "addr" passed to NewListener.
+	Addrs map[string]string
+
+	Err string
+}
+
+// runChild runs the child process of a real restart, it listens on the addresses
+// of envTestListen, waits until it reported ready and writes the report.
+func runChild() int {
+
+	report := childReport{Generation: generation, Args: os.Args[1:], Addrs: make(map[string]string)}
+	report.Executable, _ = os.Executable()
+
+	socketLock.Lock()
+	report.Inherited = append([]string{}, inheritedAddrs...)
+	socketLock.Unlock()
+
+	err := childListen(report.Addrs)
+	if err == nil {
+		err = waitChildReady(5 * time.Second)
+	}
+	if err != nil {
+		report.Err = err.Error()
+	}
+
+	if err := writeReport(os.Getenv(envTestReport), report); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if report.Err != "" {
+		return 1
+	}
+
+	// the process exits after the new process is ready.
+	if n, _ := strconv.Atoi(os.Getenv(envTestGenerations)); generation < n {
+		if err := Restart(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+func childListen(addrs map[string]string) error {
+
+	listen := os.Getenv(envTestListen)
+	if listen == "" {
+		return nil
+	}
+
+	for _, s := range strings.Split(listen, ",") {
+		parts := strings.SplitN(s, "|", 2)
+		l, err := NewListener(parts[0], parts[1])
+		if err != nil {
+			return err
+		}
+		addrs[parts[1]] = l.Addr().String()
+	}
+	return nil
+}
+
+// waitChildReady waits until the child process reported ready to the parent.
+func waitChildReady(timeout time.Duration) error {
+
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		socketLock.Lock()
+		ready := readyPipe == nil
+		socketLock.Unlock()
+
+		if ready {
+			return nil
+		}
+	}
+	return errors.New("not ready in " + timeout.String())
+}
+
+func writeReport(prefix string, report childReport) error {
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s.%d", prefix, report.Generation)
+	if err := ioutil.WriteFile(name+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// runWatcher runs a process which changes its working directory and watches its
+// executable file, it reports the automatic restart without starting the new
+// process, see TestWatchFromAnotherDirectory.
+func runWatcher() int {
+
+	report := os.Getenv(envTestReport)
+	restarted := make(chan struct{})
+	var once sync.Once
+	testhook.SetStart(func() (*os.Process, error) {
+		once.Do(func() {
+			close(restarted)
+		})
+		return &os.Process{Pid: 1<<31 - 1}, nil
+	})
+	testhook.SetExit(func(int) {})
+
+	SetWatchDelay(50 * time.Millisecond)
+	MinRestartInterval(0)
+	if err := os.Chdir(os.Getenv(envTestDir)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ListenSignal()
+	if err := ioutil.WriteFile(report+".watching", nil, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	select {
+	case <-restarted:
+		if err := ioutil.WriteFile(report+".restarted", nil, 0600); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case <-time.After(20 * time.Second):
+		return 1
+	}
+}
+
+// realRestart makes the restarts of the test start the test binary as the child
+// process, which listens on "listen"("network|addr") and reports to the returned
+// path prefix, see readReport. the process doesn't exit after the restarts.
+func realRestart(t *testing.T, listen ...string) string {
+
+	return realRestarts(t, 1, listen...)
+}
+
+// realRestarts acts like realRestart, the child processes restart until the
+// generation "generations".
+func realRestarts(t *testing.T, generations int, listen ...string) string {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the socket files are not passed on windows")
+	}
+
+	resetSocketFiles()
+	report := filepath.Join(t.TempDir(), "report")
+	SetRestartEnv(map[string]string{
+		envTestHelper:      "child",
+		envTestReport:      report,
+		envTestListen:      strings.Join(listen, ","),
+		envTestGenerations: strconv.Itoa(generations),
+	})
+	testhook.SetExit(func(int) {})
+
+	t.Cleanup(func() {
+		SetRestartEnv(nil)
+		testhook.SetExit(nil)
+		resetRestartState()
+		resetSocketFiles()
+	})
+	return report
+}
+
+// readReport waits for the report of the child process of generation "gen".
+func readReport(t *testing.T, prefix string, gen int) childReport {
+
+	var report childReport
+	if err := json.Unmarshal(waitFile(t, fmt.Sprintf("%s.%d", prefix, gen)), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Err != "" {
+		t.Fatalf("child process of generation %d: %s", gen, report.Err)
+	}
+	return report
+}
+
+// waitFile waits for the file written by a helper process and returns its content.
+func waitFile(t *testing.T, name string) []byte {
+
+	for deadline := time.Now().Add(20 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+
+		data, err := ioutil.ReadFile(name)
+		if err == nil {
+			return data
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not written", filepath.Base(name))
+		}
+	}
+}
+
+// resetSocketFiles forgets the sockets of the former tests, so they are not passed
+// to the child process.
+func resetSocketFiles() {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	for _, f := range socketFiles {
+		f.Close()
+	}
+	socketFiles, socketAddrs, boundAddrs = nil, nil, nil
+}
+
+// newTestManager returns a manager which is stopped after the test.
+func newTestManager(t *testing.T) *Manager {
+
+	m := NewManager()
+	t.Cleanup(func() {
+		m.StopGraceful()
+	})
+	return m
+}
@@ -0,0 +1,176 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Manager is a group of graceful listeners with its own close callbacks, it drains
+// and stops independently of the other managers, e.g. a public server and an
+// internal server in one binary. the package functions use a default manager.
+//
+// the process level things are shared by all managers: the socket files passed to
+// the child process, the file watcher and the flushers. a restart of any manager
+// starts a new process which inherits the sockets of all managers.
+type Manager struct {
+
+	// guards the listeners and the callbacks, they may be added from any
+	// goroutine.
+	lock sync.Mutex
+
+	listeners []net.Listener
+
+	// connects created by NewPacketConn, closed with the listeners.
+	packetConns []net.PacketConn
+
+	beforeCloseCalls []func(ctx context.Context, reason Reason)
+	afterCloseCalls  []func(ctx context.Context, reason Reason) error
+
+	// deadline of the drain, zero means no deadline.
+	drainDeadline time.Time
+
+	closeSig struct {
+		closed bool
+		sync.RWMutex
+	}
+
+	// serializes the start of the child process and the drain, a restart either
+	// starts the child process before the drain begins, or fails.
+	lifecycle sync.Mutex
+
+	waitGroup sync.WaitGroup
+
+	// number of the opened connects of the manager.
+	activeConns int64
+
+	drainOnce    sync.Once
+	shutdownOnce sync.Once
+	shutdownErr  error
+	signalOnce   sync.Once
+
+	// closed after the manager stopped without exiting the process, the Accept
+	// calls blocked by the drain return then.
+	stopped     chan struct{}
+	stoppedOnce sync.Once
+
+	// cancelled when the drain begins, see ListenNetAndServeCtx.
+	drainCtx    context.Context
+	drainCancel context.CancelFunc
+}
+
+// NewManager returns a new manager without any listener.
+func NewManager() *Manager {
+
+	m := &Manager{stopped: make(chan struct{})}
+	m.drainCtx, m.drainCancel = context.WithCancel(context.Background())
+	return m
+}
+
+// drainContext returns the context which is cancelled when the drain begins.
+func (m *Manager) drainContext() context.Context {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.drainCtx
+}
+
+// connContext returns a context of a connect handler, it's cancelled when the
+// drain begins or "parent" is done.
+func (m *Manager) connContext(parent context.Context) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(parent)
+	drain := m.drainContext()
+	go func() {
+		select {
+		case <-drain.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+var defaultManager = NewManager()
+
+// DefaultManager returns the manager used by the package functions.
+func DefaultManager() *Manager {
+
+	return defaultManager
+}
+
+// waitStopped blocks the Accept calls after the drain. the servers must not return
+// before the process exits by Stop, or the applications which exit when the server
+// returned(e.g. log.Fatal) would cut off the opened connects.
+func (m *Manager) waitStopped() error {
+
+	<-m.stopped
+	return ErrServerClosed
+}
+
+func (m *Manager) closeStopped() {
+
+	m.stoppedOnce.Do(func() {
+		close(m.stopped)
+	})
+}
+
+// ListenerAddrs returns the bound addresses of the listeners of the default
+// manager, e.g. to register the port assigned by the system for ":0" with a
+// service discovery. the child process inherits the socket created for ":0", so
+// its port stays the same across restarts.
+func ListenerAddrs() []net.Addr {
+
+	return defaultManager.ListenerAddrs()
+}
+
+// ListenerAddrs acts like the package function ListenerAddrs.
+func (m *Manager) ListenerAddrs() []net.Addr {
+
+	_, _, listeners := m.closeCalls()
+	addrs := make([]net.Addr, 0, len(listeners))
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+func (m *Manager) appendListener(l net.Listener) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.listeners = append(m.listeners, l)
+}
+
+// closeCalls returns copies of the callbacks and the listeners, so they can be run
+// without holding the lock.
+func (m *Manager) closeCalls() (
+	before []func(ctx context.Context, reason Reason),
+	after []func(ctx context.Context, reason Reason) error,
+	listeners []net.Listener,
+) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	before = append(before, m.beforeCloseCalls...)
+	after = append(after, m.afterCloseCalls...)
+	listeners = append(listeners, m.listeners...)
+	return
+}
+
+// closePacketConns closes the packet connects of the manager.
+func (m *Manager) closePacketConns() {
+	m.lock.Lock()
+	conns := append([]net.PacketConn{}, m.packetConns...)
+	m.lock.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// MetricsHooks receives the restart and drain events for the metrics, e.g. the
+// Prometheus collectors of package gracemetrics, so the package itself depends on
+// no metrics library. nil hooks are skipped, the hooks must return quickly.
+type MetricsHooks struct {
+
+	// Restarted is called after every restart attempt, "err" is nil if the new
+	// process started.
+	Restarted func(err error)
+
+	// Drained is called after the opened connects were all closed, or the drain
+	// timed out, with the duration of the drain.
+	Drained func(d time.Duration)
+}
+
+var metricsHooks atomic.Value
+
+// SetMetricsHooks installs the hooks of the metrics, it replaces the hooks installed
+// before.
+func SetMetricsHooks(hooks MetricsHooks) {
+
+	metricsHooks.Store(hooks)
+}
+
+// ActiveConns returns the number of the opened connects of all managers.
+func ActiveConns() int64 {
+
+	return atomic.LoadInt64(&activeConns)
+}
+
+// TotalConns returns the number of the connects accepted during the process
+// lifetime.
+func TotalConns() int64 {
+
+	return atomic.LoadInt64(&totalConns)
+}
+
+func metricsRestarted(err error) {
+
+	if hooks, ok := metricsHooks.Load().(MetricsHooks); ok && hooks.Restarted != nil {
+		hooks.Restarted(err)
+	}
+}
+
+func metricsDrained(d time.Duration) {
+
+	if hooks, ok := metricsHooks.Load().(MetricsHooks); ok && hooks.Drained != nil {
+		hooks.Drained(d)
+	}
+}
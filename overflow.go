@@ -0,0 +1,183 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens to new connections when the graceful
+// listeners already hold MaxConnections connections.
+type OverflowPolicy int32
+
+const (
+
+	// OverflowQueue stops accepting until a connection is closed, new connections
+	// wait in the listen queue(the operating system will refuse them if the queue
+	// is full).
+	OverflowQueue OverflowPolicy = iota
+
+	// OverflowClose accepts and closes new connections immediately, the message set
+	// by SetOverflowMessage is written before closing.
+	OverflowClose
+
+	// OverflowRespond503 writes a minimal "503 Service Unavailable" response to new
+	// connections before closing them. it only applies to the plain http listeners
+	// created by the graceful http server, other listeners fall back to OverflowClose.
+	OverflowRespond503
+)
+
+const response503 = "HTTP/1.1 503 Service Unavailable\r\n" +
+	"Connection: close\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 20\r\n" +
+	"\r\n" +
+	"Service Unavailable\n"
+
+var overflow = struct {
+	max    int64
+	policy int32
+
+	// number of the connections rejected by OverflowClose or OverflowRespond503.
+	rejected int64
+
+	// signals the queued Accept when a connection was released.
+	cond *sync.Cond
+
+	// []byte written by OverflowClose.
+	message atomic.Value
+}{cond: sync.NewCond(&sync.Mutex{})}
+
+// MaxConnections limits the number of the open connections accepted by the graceful
+// listeners to "n", and sets what to do with the connections over the limit. it can
+// be called at any time, "n" less than or equal to 0 removes the limit, which is
+// the default.
+func MaxConnections(n int, policy OverflowPolicy) {
+
+	overflow.cond.L.Lock()
+	atomic.StoreInt64(&overflow.max, int64(n))
+	atomic.StoreInt32(&overflow.policy, int32(policy))
+	overflow.cond.Broadcast()
+	overflow.cond.L.Unlock()
+}
+
+// SetOverflowMessage sets the message written to the connections closed by
+// OverflowClose, e.g. "server busy\n" for a line protocol. nil means closing
+// without any message, which is the default.
+func SetOverflowMessage(msg []byte) {
+
+	overflow.message.Store(append([]byte{}, msg...))
+}
+
+// RejectedConns returns the number of the connections rejected by MaxConnections.
+func RejectedConns() int64 {
+
+	return atomic.LoadInt64(&overflow.rejected)
+}
+
+func overflowed() bool {
+
+	max := atomic.LoadInt64(&overflow.max)
+	return max > 0 && atomic.LoadInt64(&activeConns) >= max
+}
+
+// waitConnSlot blocks until the number of the open connections is under the
+// limit, only if the policy is OverflowQueue. it returns when the manager drains
+// too, so the servers waiting for their accept loop(e.g. http.Server.Shutdown)
+// don't hang.
+func waitConnSlot(m *Manager) {
+
+	if OverflowPolicy(atomic.LoadInt32(&overflow.policy)) != OverflowQueue {
+		return
+	}
+
+	overflow.cond.L.Lock()
+	for overflowed() && OverflowPolicy(atomic.LoadInt32(&overflow.policy)) == OverflowQueue && !m.isClosed() {
+		overflow.cond.Wait()
+	}
+	overflow.cond.L.Unlock()
+}
+
+// wakeConnSlots wakes up all the queued Accept calls, e.g. the manager drained.
+func wakeConnSlots() {
+
+	overflow.cond.L.Lock()
+	overflow.cond.Broadcast()
+	overflow.cond.L.Unlock()
+}
+
+// releaseConnSlot wakes up the queued Accept.
+func releaseConnSlot() {
+
+	if atomic.LoadInt64(&overflow.max) <= 0 {
+		return
+	}
+
+	overflow.cond.L.Lock()
+	overflow.cond.Signal()
+	overflow.cond.L.Unlock()
+}
+
+// reserveConnSlot counts an accepted connection in the open connections if it's
+// under the limit, the check and the count are done at once, so the concurrent
+// Accept calls can't exceed the limit together.
+func reserveConnSlot() bool {
+
+	for {
+		max := atomic.LoadInt64(&overflow.max)
+		cur := atomic.LoadInt64(&activeConns)
+		if max > 0 && cur >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&activeConns, cur, cur+1) {
+			return true
+		}
+	}
+}
+
+// admitConn reserves a slot for the accepted connection, see MaxConnections. it
+// waits for a free slot by OverflowQueue, or rejects the connection by the other
+// policies. the connection is closed if it's not admitted.
+func admitConn(m *Manager, c net.Conn, plainHTTP bool) bool {
+
+	for !reserveConnSlot() {
+		if OverflowPolicy(atomic.LoadInt32(&overflow.policy)) != OverflowQueue {
+			rejectConn(c, plainHTTP)
+			return false
+		}
+
+		waitConnSlot(m)
+		if m.isClosed() {
+			c.Close()
+			return false
+		}
+	}
+	return true
+}
+
+// rejectConn closes the connection over the limit, the message of the policy is
+// written before closing.
+func rejectConn(c net.Conn, plainHTTP bool) {
+
+	var msg []byte
+	switch OverflowPolicy(atomic.LoadInt32(&overflow.policy)) {
+	case OverflowClose:
+		msg, _ = overflow.message.Load().([]byte)
+	case OverflowRespond503:
+		if plainHTTP {
+			msg = []byte(response503)
+		}
+	}
+
+	if len(msg) > 0 {
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.Write(msg)
+	}
+	c.Close()
+	atomic.AddInt64(&overflow.rejected, 1)
+}
@@ -0,0 +1,249 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"time"
+	"bufio"
+	"context"
+	"net/http"
+	"testing"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// limitConnections sets MaxConnections after the connections of the previous
+// tests closed, the limit is removed by the cleanup.
+func limitConnections(t *testing.T, n int, policy OverflowPolicy) {
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&activeConns) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connects still open", atomic.LoadInt64(&activeConns))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	MaxConnections(n, policy)
+	t.Cleanup(func() {
+		MaxConnections(0, OverflowQueue)
+	})
+}
+
+// acceptAsync accepts a connection in another goroutine.
+func acceptAsync(l net.Listener) <-chan net.Conn {
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	return accepted
+}
+
+func TestMaxConnectionsQueue(t *testing.T) {
+
+	const max = 2
+	limitConnections(t, max, OverflowQueue)
+
+	m := newTestManager(t)
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < max; i++ {
+		c, _ := acceptOne(t, l)
+		conns = append(conns, c)
+	}
+
+	// the (max+1)th connect waits in the listen queue.
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	accepted := acceptAsync(l)
+	select {
+	case <-accepted:
+		t.Fatalf("accepted %d connects, the limit is %d", max+1, max)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	conns[0].Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queued connect is not accepted after a connect closed")
+	}
+	conns[1].Close()
+}
+
+func TestMaxConnectionsClose(t *testing.T) {
+
+	const max = 2
+	limitConnections(t, max, OverflowClose)
+	SetOverflowMessage([]byte("busy\n"))
+	defer SetOverflowMessage(nil)
+
+	m := newTestManager(t)
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < max; i++ {
+		c, _ := acceptOne(t, l)
+		conns = append(conns, c)
+	}
+
+	rejected := RejectedConns()
+	accepted := acceptAsync(l)
+
+	// the (max+1)th connect gets the message and is closed.
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "busy\n" {
+		t.Fatalf("overflow message %q", msg)
+	}
+	if n := RejectedConns() - rejected; n != 1 {
+		t.Fatalf("%d connects rejected, want 1", n)
+	}
+
+	// the Accept keeps waiting for the connects under the limit.
+	conns[0].Close()
+	next, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connect under the limit is not accepted")
+	}
+	conns[1].Close()
+}
+
+// the Accept calls of several listeners racing for the last slots can't exceed
+// the limit together.
+func TestMaxConnectionsConcurrentAccept(t *testing.T) {
+
+	const max, listeners = 2, 4
+	limitConnections(t, max, OverflowQueue)
+
+	m := newTestManager(t)
+	accepted := make(chan net.Conn, listeners)
+	var addrs []string
+	for i := 0; i < listeners; i++ {
+		l, err := m.NewListener("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				accepted <- c
+			}
+		}()
+	}
+
+	// let all the Accept calls pass the queue while no connect is open.
+	time.Sleep(100 * time.Millisecond)
+	for _, addr := range addrs {
+		client, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	timeout := time.After(500 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case c := <-accepted:
+			conns = append(conns, c)
+		case <-timeout:
+			waiting = false
+		}
+	}
+	if len(conns) != max {
+		t.Fatalf("accepted %d connects, the limit is %d", len(conns), max)
+	}
+}
+
+func TestMaxConnectionsQueueDrain(t *testing.T) {
+
+	limitConnections(t, 1, OverflowQueue)
+
+	m := newTestManager(t)
+	l, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ReturnOnDrain(l)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(l)
+
+	// an idle keep-alive connection holds the only slot, the next Accept is
+	// queued.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: grace\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Shutdown waits for the queued Accept before closing the idle connection,
+	// the listener closed by the drain is reported too.
+	m.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	// Shutdown ignores the deadline while waiting for the accept loop.
+	select {
+	case err := <-shutdown:
+		if err == context.DeadlineExceeded {
+			t.Fatal("Shutdown is waiting for the queued Accept")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown is waiting for the queued Accept")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"context"
+	"net"
+)
+
+// packetAddrPrefix prefixes the addresses of the packet connections, so a UDP
+// socket never conflicts with a TCP socket of the same address.
+const packetAddrPrefix = "packet:"
+
+// NewPacketConn returns a graceful packet connection, e.g. for DNS or QUIC over
+// UDP. like the listeners, the socket is passed to the child process on restart,
+// so the packets keep being queued during the handoff, and the connection is closed
+// by Drain or Stop. e.g. an echo server:
+//
+//	c, err := grace.NewPacketConn("udp", ":8053")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	buf := make([]byte, 1500)
+//	for {
+//		n, addr, err := c.ReadFrom(buf)
+//		if err != nil {
+//			return
+//		}
+//		c.WriteTo(buf[:n], addr)
+//	}
+//
+// like Accept of the listeners, ReadFrom blocks after the connection closed by the
+// drain, until the process exits by Stop, or returns ErrServerClosed after the
+// manager stopped by StopGraceful.
+func NewPacketConn(network, addr string) (net.PacketConn, error) {
+
+	return defaultManager.NewPacketConn(network, addr)
+}
+
+// NewPacketConn acts like the package function NewPacketConn, the connection
+// belongs to the manager.
+func (m *Manager) NewPacketConn(network, addr string) (c net.PacketConn, err error) {
+
+	key := packetAddrPrefix + addr
+	if osSupportSocketFile {
+
+		// handle as child process
+		if f := claimSocketFile(key); f != nil {
+			c, err = net.FilePacketConn(f)
+			if err != nil {
+				return nil, err
+			}
+			return m.appendPacketConn(c), nil
+		}
+
+		c, err = listenPacket(network, addr)
+		if err != nil {
+			return nil, listenError(network, addr, err)
+		}
+
+		// handle as parent process
+		if sf, ok := c.(supportSocketFile); ok {
+			f, err := sf.File()
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			addSocketFile(key, f)
+		}
+
+		return m.appendPacketConn(c), nil
+	}
+
+	c, err = listenPacket(network, addr)
+	if err != nil {
+		return nil, listenError(network, addr, err)
+	}
+
+	rebound(key)
+	return m.appendPacketConn(c), nil
+}
+
+// listenPacket creates a packet connection with the socket options.
+func listenPacket(network, addr string) (net.PacketConn, error) {
+
+	lc := net.ListenConfig{Control: controlSocket}
+	return lc.ListenPacket(context.Background(), network, addr)
+}
+
+func (m *Manager) appendPacketConn(c net.PacketConn) net.PacketConn {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.packetConns = append(m.packetConns, c)
+	return &netPacketConn{PacketConn: c, m: m}
+}
+
+type netPacketConn struct {
+	net.PacketConn
+
+	m *Manager
+}
+
+func (n *netPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+
+	nr, addr, err := n.PacketConn.ReadFrom(b)
+	if err != nil && n.m.isClosed() {
+
+		// the connection was closed by the drain, cover the error like
+		// netListener.Accept.
+		return nr, addr, n.m.waitStopped()
+	}
+	return nr, addr, err
+}
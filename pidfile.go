@@ -0,0 +1,83 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"context"
+	"strconv"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// WritePIDFile writes the pid of the current process to the file "path", the
+// file is written to a temporary file and renamed, so a reader never sees a
+// partial pid. e.g. for "kill -HUP $(cat app.pid)":
+//
+//	if err := grace.WritePIDFile("/var/run/app.pid"); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// the child process started by Restart runs the same code and overwrites the
+// file with its own pid, so the file points at the new process once it's
+// initialized. the file is removed after the process stopped by Stop or a signal,
+// but kept on restart. it's only removed if it still holds the pid of the current
+// process.
+func WritePIDFile(path string) error {
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(strconv.Itoa(pid) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	AfterCloseCallCtx(func(ctx context.Context, reason Reason) error {
+		if reason == ReasonRestart {
+			return nil
+		}
+		return removePIDFile(path)
+	})
+	return nil
+}
+
+// removePIDFile removes the pid file if it holds the pid of the current process.
+func removePIDFile(path string) error {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if strings.TrimSpace(string(data)) != strconv.Itoa(pid) {
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"sync"
+	"time"
+)
+
+var acceptRate = &tokenBucket{}
+
+// AcceptRateLimit paces how fast the graceful listeners admit new connections,
+// at most "perSec" connections per second with bursts up to "burst" connections.
+// excess connections are delayed in the listen queue(the operating system will
+// refuse them if the queue is full). it can be called at any time to adjust the
+// rate, a "perSec" less than or equal to 0 removes the limit.
+func AcceptRateLimit(perSec, burst int) {
+
+	acceptRate.set(float64(perSec), float64(burst))
+}
+
+// tokenBucket is a token bucket rate limiter, the zero value means unlimited.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func (b *tokenBucket) set(rate, burst float64) {
+	b.Lock()
+	defer b.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+	b.rate = rate
+	b.burst = burst
+	b.tokens = burst
+	b.last = time.Now()
+}
+
+// reserve takes one token and returns the duration the caller should wait
+// before the token is available.
+func (b *tokenBucket) reserve() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// on the platforms which support passing socket files, the child process writes a
+// byte to the ready pipe after it used all the inherited sockets, or a moment after
+// the last one used if the others are never used, the parent process keeps serving
+// until then, so a child process which failed on startup(bad config, failed
+// migration...) doesn't cause an outage.
+
+// envReadyFD passes the file descriptor of the ready pipe to the child process.
+const envReadyFD = "GRACE_READY_FD"
+
+var (
+	// maximum duration the parent process waits for the child process ready.
+	readyTimeout = 10 * time.Second
+
+	// the writer of the ready pipe in the child process, guarded by socketLock.
+	readyPipe *os.File
+
+	// inherited sockets which are not used by NewListener yet, guarded by
+	// socketLock.
+	pendingSockets = make(map[string]bool)
+
+	// how long the child process waits for the remaining inherited sockets after
+	// one used, the ones still unused then are taken as not used by the new version
+	// any more, e.g. it doesn't listen on some address. it must be shorter than the
+	// ready timeout of the parent process.
+	readySettle = time.Second
+
+	// reports ready after the settle, guarded by socketLock.
+	readyTimer *time.Timer
+)
+
+// SetReadyTimeout sets how long Restart waits for the child process ready, a child
+// process not ready in time will be killed and the current process continues to
+// serve. the default is 10 seconds, 0 disables the handshake, e.g. when the new
+// executable file uses an old version of this package which never reports ready.
+func SetReadyTimeout(d time.Duration) {
+
+	readyTimeout = d
+}
+
+// Ready tells the parent process that the child process is ready to serve, the
+// parent process starts to drain then. it's called automatically after all the
+// inherited sockets used by NewListener, or a second after the last one used if the
+// new version doesn't listen on some address any more. call it if the new version
+// uses none of the inherited sockets, or to signal after more startup work(e.g.
+// warming the caches). calling it more than once or in a process without parent has
+// no effect.
+func Ready() {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	markReady()
+}
+
+// markReady writes the ready byte, the caller must hold the socketLock.
+func markReady() {
+
+	if readyTimer != nil {
+		readyTimer.Stop()
+	}
+
+	if readyPipe == nil {
+		return
+	}
+
+	if _, err := readyPipe.Write([]byte{1}); err != nil {
+		logf("write ready pipe failed! %v\n", err)
+	}
+	readyPipe.Close()
+	readyPipe = nil
+}
+
+// initReadyPipe opens the ready pipe passed by the parent process.
+func initReadyPipe() {
+
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	os.Unsetenv(envReadyFD)
+	if err != nil {
+		return
+	}
+	readyPipe = os.NewFile(uintptr(fd), "ready-pipe")
+}
+
+// addPendingSocket records an inherited socket, the caller must hold the socketLock.
+func addPendingSocket(addr string) {
+
+	if !strings.HasPrefix(addr, inheritedFilePrefix) {
+		pendingSockets[addr] = true
+	}
+}
+
+// claimPendingSocket marks the inherited socket used, the child process is ready
+// after all of them used, or after the settle since the last one used. the caller
+// must hold the socketLock.
+func claimPendingSocket(addr string) {
+
+	delete(pendingSockets, addr)
+	if len(pendingSockets) == 0 {
+		markReady()
+		return
+	}
+
+	if readyPipe == nil {
+		return
+	}
+	if readyTimer == nil {
+		readyTimer = time.AfterFunc(readySettle, Ready)
+		return
+	}
+	readyTimer.Reset(readySettle)
+}
+
+// waitReady waits for the child process ready, the child process will be killed if
+// it's not ready in time. a child process which exited before ready(e.g. crashed on
+// startup) is reported with its exit code, so the current process rolls back to
+// serving.
+func waitReady(r *os.File, p *os.Process, exited <-chan *os.ProcessState) error {
+
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+
+	defer r.Close()
+	timeout := time.After(readyTimeout)
+	select {
+	case ok := <-ready:
+		if ok {
+			return nil
+		}
+
+		// the pipe was closed, the child process is exiting.
+		select {
+		case state := <-exited:
+			return exitedError(state)
+		case <-time.After(time.Second):
+			p.Kill()
+			return errors.New("grace: the new process closed the ready pipe before ready")
+		}
+	case state := <-exited:
+
+		// the child process may exit right after ready, the pipe is closed
+		// with it, so the read returns soon.
+		select {
+		case ok := <-ready:
+			if ok {
+				return nil
+			}
+		case <-time.After(time.Second):
+		}
+		return exitedError(state)
+	case <-timeout:
+		p.Kill()
+		return errors.New("grace: the new process is not ready in " + readyTimeout.String())
+	}
+}
+
+func exitedError(state *os.ProcessState) error {
+
+	logf("new process exited before ready, exit code: %d\n", state.ExitCode())
+	return fmt.Errorf("grace: the new process exited before ready: %v", state)
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestartShrinksListenSet(t *testing.T) {
+
+	// the new version only listens on the first address.
+	report := realRestart(t, "tcp|127.0.0.1:0")
+
+	m := newTestManager(t)
+	kept, err := m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.NewListener("tcp", "127.0.0.2:0"); err != nil {
+		t.Skip(err)
+	}
+
+	start := time.Now()
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ready by the settle, long before the ready timeout.
+	if d := time.Since(start); d >= readyTimeout/2 {
+		t.Fatalf("restart took %s", d)
+	}
+
+	child := readReport(t, report, 1)
+	if len(child.Inherited) != 2 {
+		t.Fatalf("inherited %v, want both sockets", child.Inherited)
+	}
+	if got := child.Addrs["127.0.0.1:0"]; got != kept.Addr().String() {
+		t.Fatalf("child process bound %s, want %s", got, kept.Addr())
+	}
+}
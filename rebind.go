@@ -0,0 +1,125 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
+)
+
+// on the platforms which don't support passing socket files(windows), the child
+// process binds the same addresses by SO_REUSEADDR before the parent process
+// closes its listeners, and creates the ready file after all addresses bound.
+
+// envReadyFile passes the path of the ready file to the child process.
+const envReadyFile = "GRACE_READY_FILE"
+
+// how long the parent process waits for the child process bound all addresses.
+const rebindTimeout = 10 * time.Second
+
+var (
+	// addresses bound by NewListener, guarded by socketLock.
+	boundAddrs []string
+
+	// addresses the child process should bind before it's ready, guarded by
+	// socketLock.
+	pendingAddrs map[string]bool
+)
+
+// initRebind reads the addresses of the parent process, it's called in the child
+// process.
+func initRebind() {
+
+	if os.Getenv(envReadyFile) == "" {
+		return
+	}
+
+	pendingAddrs = make(map[string]bool)
+	if addrs := os.Getenv(envListenAddrs); addrs != "" {
+		for _, addr := range strings.Split(addrs, ",") {
+			pendingAddrs[addr] = true
+		}
+	}
+	os.Unsetenv(envListenAddrs)
+
+	if len(pendingAddrs) == 0 {
+		markRebindReady()
+	}
+}
+
+// rebound records the bound address, the child process is ready after all the
+// addresses of the parent process bound.
+func rebound(addr string) {
+	socketLock.Lock()
+	defer socketLock.Unlock()
+
+	boundAddrs = append(boundAddrs, addr)
+	if pendingAddrs == nil || !pendingAddrs[addr] {
+		return
+	}
+
+	delete(pendingAddrs, addr)
+	if len(pendingAddrs) == 0 {
+		markRebindReady()
+	}
+}
+
+func markRebindReady() {
+
+	name := os.Getenv(envReadyFile)
+	os.Unsetenv(envReadyFile)
+	pendingAddrs = nil
+
+	if err := ioutil.WriteFile(name, []byte("ready"), 0600); err != nil {
+		logf("create ready file failed! %v\n", err)
+	}
+}
+
+// startRebindProcess starts the child process and waits until it bound all the
+// addresses of the current process, the child process will be killed if it's not
+// ready in time.
+func startRebindProcess(opts restartOptions) (*os.Process, error) {
+
+	// simulated by gracetest.
+	if start := testhook.Start(); start != nil {
+		return start()
+	}
+
+	f, err := ioutil.TempFile("", "grace-ready-")
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	f.Close()
+
+	// the child process creates the file when it's ready.
+	os.Remove(name)
+	defer os.Remove(name)
+
+	socketLock.Lock()
+	addrs := strings.Join(boundAddrs, ",")
+	socketLock.Unlock()
+
+	p, err := startNewProcess(opts, envReadyFile+"="+name, envListenAddrs+"="+addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(rebindTimeout)
+	for time.Now().Before(deadline) {
+
+		if _, err := os.Stat(name); err == nil {
+			return p, nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	p.Kill()
+	return p, errors.New("grace: the new process didn't bind the addresses in time")
+}
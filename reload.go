@@ -0,0 +1,194 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"errors"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 1 if ReloadInPlace is running.
+	reloading int32
+
+	// serializes ReloadInPlace.
+	reloadLock sync.Mutex
+
+	beforeReloadCalls     []func() error
+	beforeReloadCallsLock sync.Mutex
+
+	// maximum duration ReloadInPlace waits for the opened connects.
+	reloadTimeout = 30 * time.Second
+
+	acceptGate = struct {
+		paused bool
+		cond   *sync.Cond
+	}{cond: sync.NewCond(&sync.Mutex{})}
+)
+
+// BeforeReloadCall caches callbacks, they will be run in order by ReloadInPlace
+// after all opened connects closed and before the init function, most of time
+// we tear down the handlers, database pools or anything the init function
+// rebuilds here.
+func BeforeReloadCall(call func() error) {
+
+	beforeReloadCallsLock.Lock()
+	defer beforeReloadCallsLock.Unlock()
+
+	beforeReloadCalls = append(beforeReloadCalls, call)
+}
+
+// SetReloadTimeout sets the maximum duration ReloadInPlace waits for the opened
+// connects, the remaining connects keep being served by the old handlers. the
+// default is 30 seconds.
+func SetReloadTimeout(d time.Duration) {
+
+	reloadTimeout = d
+}
+
+// ReloadInPlace "restarts" the application without starting a new process, for
+// the environments where exec is forbidden(e.g. read-only file system, sandboxes).
+// it pauses accepting on the graceful listeners(the listeners are not closed, new
+// connections wait in the listen queue), closes the idle http connects and waits
+// for the opened connects, runs the BeforeReloadCall callbacks, then runs "init" to
+// rebuild the handlers and config, and resumes accepting on the same listeners.
+//
+// it doesn't pick up new binary code, use Restart for a new executable file. the
+// listeners resume even if "init" failed, the error is returned, so "init" should
+// keep the application in a working state on failure.
+//
+// the connect calling ReloadInPlace would be waited for until the reload timeout,
+// call ReloadInPlaceCtx from a connect handler instead.
+func ReloadInPlace(init func() error) error {
+
+	return ReloadInPlaceCtx(context.Background(), init)
+}
+
+// ReloadInPlaceCtx acts like ReloadInPlace, but the connect serving "ctx" is not
+// waited for, e.g. an admin endpoint reloading the application by the request:
+//
+//	http.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+//		if err := grace.ReloadInPlaceCtx(r.Context(), initApp); err != nil {
+//			http.Error(w, err.Error(), http.StatusInternalServerError)
+//		}
+//	})
+//
+// "ctx" is the context of a request of the graceful http servers, or of a
+// handler of ListenNetAndServeCtx.
+func ReloadInPlaceCtx(ctx context.Context, init func() error) error {
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if isClosed() || atomic.LoadInt32(&restarting) == 1 {
+		return errors.New("grace: the process is stopping or restarting")
+	}
+
+	atomic.StoreInt32(&reloading, 1)
+	pauseAccept()
+	defer func() {
+		resumeAccept()
+		atomic.StoreInt32(&reloading, 0)
+	}()
+
+	logf("reloading in place...\n")
+	closeIdleHTTPConns()
+	self := connFromContext(ctx)
+	if !waitActiveConns(reloadTimeout, self) {
+		logf("reload timeout after %s, %d connects are still opened.\n", reloadTimeout, atomic.LoadInt64(&activeConns)-ownConns(self))
+	}
+
+	beforeReloadCallsLock.Lock()
+	calls := append([]func() error{}, beforeReloadCalls...)
+	beforeReloadCallsLock.Unlock()
+
+	for _, call := range calls {
+		if err := runCallback(call); err != nil {
+			logf("before reload callback failed! %v\n", err)
+		}
+	}
+
+	if err := runCallback(init); err != nil {
+		logf("reload init failed! %v\n", err)
+		return err
+	}
+	logf("reloaded!\n")
+	return nil
+}
+
+func isReloading() bool {
+
+	return atomic.LoadInt32(&reloading) == 1
+}
+
+func pauseAccept() {
+
+	acceptGate.cond.L.Lock()
+	acceptGate.paused = true
+	acceptGate.cond.L.Unlock()
+}
+
+func resumeAccept() {
+
+	acceptGate.cond.L.Lock()
+	acceptGate.paused = false
+	acceptGate.cond.Broadcast()
+	acceptGate.cond.L.Unlock()
+}
+
+// waitAccept blocks while the accepting is paused by ReloadInPlace.
+func waitAccept() {
+
+	acceptGate.cond.L.Lock()
+	for acceptGate.paused {
+		acceptGate.cond.Wait()
+	}
+	acceptGate.cond.L.Unlock()
+}
+
+// closeIdleHTTPConns closes the idle connects of the graceful http servers, the
+// connects become idle later are closed by the server's ConnState hook.
+func closeIdleHTTPConns() {
+
+	connsLock.Lock()
+	var idles []*netConn
+	for n := range conns {
+		if atomic.LoadInt32(&n.http) == 1 && atomic.LoadInt32(&n.idle) == 1 {
+			idles = append(idles, n)
+		}
+	}
+	connsLock.Unlock()
+
+	for _, n := range idles {
+		n.Close()
+	}
+}
+
+// waitActiveConns waits at most "timeout" for all opened connects closed except
+// "self"(nil means none), unlike waitConns it doesn't use the wait group, the
+// listeners will accept again later.
+func waitActiveConns(timeout time.Duration, self *netConn) bool {
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&activeConns) > ownConns(self) {
+		if timeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// ownConns returns 1 if the connect "self" is still opened, it's not waited for.
+func ownConns(self *netConn) int64 {
+
+	if self != nil && atomic.LoadInt32(&self.released) == 0 {
+		return 1
+	}
+	return 0
+}
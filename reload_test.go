@@ -0,0 +1,55 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"io"
+	"time"
+	"testing"
+	"net/http"
+	"sync/atomic"
+)
+
+// the connect of the handler calling ReloadInPlaceCtx must not be waited for.
+func TestReloadInPlaceFromHandler(t *testing.T) {
+
+	SetReloadTimeout(5 * time.Second)
+	defer SetReloadTimeout(30 * time.Second)
+
+	var inits int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		err := ReloadInPlaceCtx(r.Context(), func() error {
+			atomic.AddInt32(&inits, 1)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	srv := &Server{Server: &http.Server{Handler: handler}}
+	addr, _ := listenAndServe(t, srv, srv.ListenAndServe)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	defer client.CloseIdleConnections()
+
+	start := time.Now()
+	resp, err := client.Get("http://" + addr + "/reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("the reload waited %s for its own connect", d)
+	}
+	if n := atomic.LoadInt32(&inits); n != 1 {
+		t.Fatalf("init called %d times", n)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace_test
+
+import (
+	"sync"
+	"testing"
+	"gopkg.in/orivil/grace.v1"
+	"gopkg.in/orivil/grace.v1/gracetest"
+)
+
+func TestConcurrentRestart(t *testing.T) {
+
+	h := gracetest.New(t)
+	m := grace.NewManager()
+	if _, err := m.NewListener("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. a signal, the file watcher and the application at the same time.
+	const n = 3
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+			errs <- m.Restart()
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	var restarted, rejected int
+	for err := range errs {
+		switch err {
+		case nil:
+			restarted++
+		case grace.ErrRestartInProgress:
+			rejected++
+		default:
+			t.Fatal(err)
+		}
+	}
+
+	if h.Starts() != 1 {
+		t.Fatalf("started %d child processes, want 1", h.Starts())
+	}
+	if restarted != 1 || rejected != n-1 {
+		t.Fatalf("%d restarted and %d rejected, want 1 and %d", restarted, rejected, n-1)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RestartResult records a restart attempt.
+type RestartResult struct {
+	Time time.Time `json:"time"`
+
+	// why the process restarted, e.g. "signal: hangup", "file".
+	Reason string `json:"reason"`
+
+	PID        int `json:"pid"`
+	ChildPID   int `json:"child_pid,omitempty"`
+	Generation int `json:"generation"`
+
+	// addresses passed to the child process.
+	Addrs []string `json:"addrs"`
+
+	// whether the child process confirmed it's ready.
+	Ready bool `json:"ready"`
+
+	// how long the current process waited for its connects after the child
+	// process started.
+	DrainDuration time.Duration `json:"drain_duration"`
+
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
+}
+
+var (
+	restartLog = struct {
+		path string
+		sync.Mutex
+	}{}
+
+	// result of the succeeded restart, it's written after the drain.
+	pendingRestart atomic.Value
+)
+
+// SetRestartLog sets a file to record every restart attempt, a JSON line of
+// RestartResult is appended to the file per restart. unlike the standard output
+// which may be lost, the file persists after the process exited, it helps to
+// debug flaky deploys after the fact. an empty path disables it.
+func SetRestartLog(path string) {
+	restartLog.Lock()
+	defer restartLog.Unlock()
+
+	restartLog.path = path
+}
+
+func newRestartResult(p *os.Process, err error) *RestartResult {
+
+	result := &RestartResult{
+		Time:       time.Now(),
+		Reason:     getExitReason(),
+		PID:        pid,
+		Generation: generation,
+		Succeeded:  err == nil,
+	}
+
+	if p != nil {
+		result.ChildPID = p.Pid
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	socketLock.Lock()
+	if osSupportSocketFile {
+		result.Addrs = append([]string{}, socketAddrs...)
+
+		// the child process used all the inherited sockets.
+		result.Ready = err == nil
+	} else {
+		result.Addrs = append([]string{}, boundAddrs...)
+
+		// the child process bound all addresses.
+		result.Ready = reuseSupported && err == nil
+	}
+	socketLock.Unlock()
+
+	return result
+}
+
+func writeRestartLog(result *RestartResult) {
+	restartLog.Lock()
+	defer restartLog.Unlock()
+
+	if restartLog.path == "" {
+		return
+	}
+
+	f, err := os.OpenFile(restartLog.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logf("open restart log failed! %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(result); err != nil {
+		logf("write restart log failed! %v\n", err)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package grace
+
+import (
+	"syscall"
+)
+
+// the socket files are passed to the child process, no need to rebind.
+const reuseSupported = false
+
+func setReuseAddr(c syscall.RawConn) error {
+
+	return nil
+}
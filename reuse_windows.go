@@ -0,0 +1,32 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"syscall"
+)
+
+// SO_REUSEADDR lets the child process bind the addresses before the parent
+// process closes its listeners.
+//
+// duplicating the listening sockets into the child process by WSADuplicateSocket
+// would share the accept queues like the socket files on unix, but the child
+// process can't use the duplicated sockets: net.FileListener and net.FileConn
+// are not supported on windows, and a net.Listener can't be built from a raw
+// socket handle outside the net package, which owns the IOCP poller. so the
+// WSADuplicateSocket handoff is declined, the rebind is the windows restart.
+const reuseSupported = true
+
+func setReuseAddr(c syscall.RawConn) error {
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
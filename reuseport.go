@@ -0,0 +1,80 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// reusePortPrefix prefixes the addresses of the SO_REUSEPORT listeners, so they
+// never conflict with the listeners created by NewListener.
+const reusePortPrefix = "reuseport:"
+
+// NewListenerReusePort acts like NewListener, but sets SO_REUSEPORT and
+// SO_REUSEADDR on the socket before binding, so several processes can listen on
+// the same address and the kernel distributes the connects among them, e.g. a
+// pre-forked worker per core:
+//
+//	l, err := grace.NewListenerReusePort("tcp", ":8080")
+//
+// every worker restarts independently, its socket is passed to its own child
+// process like the other listeners. it returns an error on the platforms without
+// SO_REUSEPORT, e.g. windows.
+func NewListenerReusePort(network, addr string) (net.Listener, error) {
+
+	return defaultManager.NewListenerReusePort(network, addr)
+}
+
+// NewListenerReusePort acts like the package function NewListenerReusePort, the
+// listener belongs to the manager.
+func (m *Manager) NewListenerReusePort(network, addr string) (net.Listener, error) {
+
+	if !reusePortSupported || !osSupportSocketFile {
+		return nil, errors.New("grace: SO_REUSEPORT is not supported on " + runtime.GOOS)
+	}
+
+	key := reusePortPrefix + addr
+
+	// handle as child process
+	if f := claimSocketFile(key); f != nil {
+		l, err := net.FileListener(f)
+		if err != nil {
+			return nil, err
+		}
+		l = &netListener{Listener: l, m: m}
+		m.appendListener(l)
+		return l, nil
+	}
+
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+
+		if err := controlSocket(network, address, c); err != nil {
+			return err
+		}
+		return setReusePort(c)
+	}}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, listenError(network, addr, err)
+	}
+
+	// handle as parent process
+	if sf, ok := l.(supportSocketFile); ok {
+		f, err := sf.File()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		addSocketFile(key, f)
+	}
+
+	l = &netListener{Listener: l, m: m}
+	m.appendListener(l)
+	return l, nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package grace
+
+import (
+	"syscall"
+)
+
+const reusePortSupported = false
+
+func setReusePort(c syscall.RawConn) error {
+
+	return nil
+}
@@ -9,8 +9,10 @@ import (
 	"net"
 	"time"
 	"crypto/tls"
-	"bytes"
-	"encoding/gob"
+	"sync"
+	"sync/atomic"
+	"errors"
+	"context"
 )
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -19,8 +21,14 @@ import (
 // go away.
 type tcpKeepAliveListener struct {
 	*netListener
+
+	// keep-alive period, negative disables keep-alives.
+	period time.Duration
 }
 
+// defaultKeepAlivePeriod is the keep-alive period if Server.KeepAlivePeriod is zero.
+const defaultKeepAlivePeriod = 3 * time.Minute
+
 func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 
 	tc, err := ln.netListener.Accept()
@@ -28,10 +36,23 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	tkc := tc.(*netConn).Conn.(*net.TCPConn)
+	// the connection may be wrapped by the ConnWrapper, and may not be a TCP
+	// connection, e.g. a unix socket.
+	n := lookupConn(tc)
+	if n == nil {
+		return tc, nil
+	}
+	tkc, ok := n.Conn.(*net.TCPConn)
+	if !ok {
+		return tc, nil
+	}
 
-	tkc.SetKeepAlive(true)
-	tkc.SetKeepAlivePeriod(3 * time.Minute)
+	if ln.period < 0 {
+		tkc.SetKeepAlive(false)
+	} else {
+		tkc.SetKeepAlive(true)
+		tkc.SetKeepAlivePeriod(ln.period)
+	}
 	return tc, nil
 }
 
@@ -39,6 +60,297 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 type Server struct {
 
 	*http.Server
+
+	// RequestTimeout is the maximum duration of the handlers, requests which
+	// run longer will be responded with "503 Service Unavailable". zero means
+	// no timeout.
+	RequestTimeout time.Duration
+
+	// DrainRequestTimeout shortens RequestTimeout while the process is draining,
+	// so the drain time is predictable. zero means no change.
+	DrainRequestTimeout time.Duration
+
+	// Manager owns the listener of the server, nil means the default manager.
+	Manager *Manager
+
+	// KeepAlivePeriod is the TCP keep-alive period of the connections accepted by
+	// ListenAndServe and ListenAndServeTLS, zero means 3 minutes, negative disables
+	// the keep-alives.
+	KeepAlivePeriod time.Duration
+
+	setup sync.Once
+
+	// *tls.Config installed by SetTLSConfig.
+	tlsConfig atomic.Value
+
+	// *tls.Certificate loaded by ReloadCertificate.
+	cert atomic.Value
+}
+
+// NewServer returns a graceful http server, the caller holds the server to stop it
+// by application logic, e.g. a Kubernetes preStop hook:
+//
+//	srv := grace.NewServer(":8080", handler)
+//	go srv.ListenAndServe()
+//
+//	...
+//
+//	// preStop
+//	err := srv.Stop()
+func NewServer(addr string, handler http.Handler) *Server {
+
+	return &Server{Server: &http.Server{Addr: addr, Handler: handler}}
+}
+
+// Stop stops the manager of the server(the default manager if srv.Manager is nil),
+// it returns after all opened connects closed and the close callbacks run, see
+// StopGraceful. use the package function Stop to exit the process instead.
+//
+// the http server is shut down by http.Server.Shutdown at the same time, so the
+// idle keep-alive connections are closed immediately and the active ones right
+// after their responses, rather than holding the drain until they time out. the
+// manager still counts the connections(including the hijacked ones, which
+// Shutdown doesn't track), Stop returns when the count reaches zero.
+func (srv *Server) Stop() error {
+
+	go srv.shutdown(0)
+	return srv.manager().StopGraceful()
+}
+
+// StopWithTimeout acts like Stop, but waits at most "d" for the opened connects,
+// the remaining connects are closed forcibly, see the package function
+// StopWithTimeout.
+func (srv *Server) StopWithTimeout(d time.Duration) error {
+
+	go srv.shutdown(d)
+	return srv.manager().StopWithTimeout(d)
+}
+
+// shutdown shuts down the http server, "timeout" is the drain deadline, 0 means
+// no deadline.
+func (srv *Server) shutdown(timeout time.Duration) {
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Shutdown waits for Serve, which returns by the drain, see Serve.
+	<-srv.manager().drainContext().Done()
+
+	// the manager closes the remaining connections after the deadline.
+	if err := srv.Shutdown(ctx); err != nil && err != context.DeadlineExceeded {
+		logf("shutdown http server failed! %v\n", err)
+	}
+}
+
+// ReloadCertificate loads the certificate and the matching private key, and swaps
+// them in for the server started by ListenAndServeTLS, the new handshakes use the
+// new certificate immediately, the opened connections are untouched. e.g. after a
+// Let's Encrypt renewal:
+//
+//	if err := srv.ReloadCertificate("cert.pem", "key.pem"); err != nil {
+//		log.Printf("reload certificate failed: %v", err)
+//	}
+//
+// the current certificate is kept if the files are invalid. the certFile and
+// keyFile passed to ListenAndServeTLS are loaded by it too.
+func (srv *Server) ReloadCertificate(certFile, keyFile string) error {
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	srv.cert.Store(&cert)
+	return nil
+}
+
+// getCertificate returns a GetCertificate callback which serves the certificate
+// loaded by ReloadCertificate, "next" still selects the certificate of the SNI
+// handshakes if it's not nil, e.g. for ACME.
+func (srv *Server) getCertificate(next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+		if next != nil && hello.ServerName != "" {
+			cert, err := next(hello)
+			if cert != nil || err != nil {
+				return cert, err
+			}
+		}
+
+		if cert, ok := srv.cert.Load().(*tls.Certificate); ok {
+			return cert, nil
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, errors.New("grace: no certificate")
+	}
+}
+
+// SetTLSConfig replaces the whole TLS config of the server started by
+// ListenAndServeTLS at runtime, e.g. to change the cipher suites, min version or
+// ALPN protocols in response to a security advisory without restarting. the new
+// handshakes use the new config, the opened connections keep their negotiated
+// parameters. the config must contain the certificates, it's copied and its
+// NextProtos gets "h2" if the server serves HTTP/2 and "http/1.1", see
+// ListenAndServeTLS.
+func (srv *Server) SetTLSConfig(cfg *tls.Config) {
+
+	cfg = cfg.Clone()
+	cfg.VerifyConnection = countHandshakes(cfg.VerifyConnection)
+	srv.tlsConfig.Store(cfg)
+}
+
+// configForClient returns a GetConfigForClient callback which prefers the config
+// installed by SetTLSConfig.
+func (srv *Server) configForClient(next func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+
+		if cfg, ok := srv.tlsConfig.Load().(*tls.Config); ok {
+
+			// the HTTP/2 support is known once the server is serving, the
+			// adjusted config replaces the installed one for the next handshakes.
+			protos := srv.nextProtos(cfg.NextProtos)
+			if !strSliceEqual(protos, cfg.NextProtos) {
+				adjusted := cfg.Clone()
+				adjusted.NextProtos = protos
+				srv.tlsConfig.CompareAndSwap(cfg, adjusted)
+				cfg = adjusted
+			}
+			return cfg, nil
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+// nextProtos returns the ALPN protocols of the config installed by SetTLSConfig,
+// "h2" is offered only if http.Server.ServeTLS set up HTTP/2 for the server, so a
+// client never negotiates a protocol which isn't served, and "http/1.1" is
+// appended.
+func (srv *Server) nextProtos(protos []string) []string {
+
+	h2 := srv.TLSNextProto["h2"] != nil
+	var adjusted []string
+	if h2 && !strSliceContains(protos, "h2") {
+		adjusted = append(adjusted, "h2")
+	}
+	for _, p := range protos {
+		if p != "h2" || h2 {
+			adjusted = append(adjusted, p)
+		}
+	}
+	if !strSliceContains(adjusted, "http/1.1") {
+		adjusted = append(adjusted, "http/1.1")
+	}
+	return adjusted
+}
+
+// Serve accepts incoming connections on the Listener l, see http.Server.Serve.
+func (srv *Server) Serve(l net.Listener) error {
+
+	srv.setup.Do(srv.setupHandler)
+
+	// http.Server.Shutdown waits for the accept loop, see ReturnOnDrain.
+	ReturnOnDrain(l)
+	return srv.wait(srv.Server.Serve(l))
+}
+
+// wait holds the ErrServerClosed returned by the drain until the manager stopped,
+// so the server still doesn't return before the opened connects closed.
+func (srv *Server) wait(err error) error {
+
+	if err == ErrServerClosed && srv.manager().isClosed() {
+		return srv.manager().waitStopped()
+	}
+	return err
+}
+
+func (srv *Server) setupHandler() {
+
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler = trackRequests(handler)
+
+	if srv.RequestTimeout > 0 {
+		handler = timeoutHandler(srv.manager(), handler, srv.RequestTimeout, srv.DrainRequestTimeout)
+	}
+	srv.Handler = handler
+
+	// the requests know their connection, see ReloadInPlaceCtx.
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return withConn(ctx, c)
+	}
+
+	// mark the idle connections, see OnDrainIdleConn and DrainBreakdown.
+	connState := srv.ConnState
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+
+		if n := lookupConn(c); n != nil {
+			atomic.StoreInt32(&n.http, 1)
+		}
+
+		// a new connection is waiting for its first request, just like
+		// an idle keep-alive connection.
+		SetConnIdle(c, state == http.StateIdle || state == http.StateNew)
+
+		// let the keep-alive connection go, see ReloadInPlace.
+		if state == http.StateIdle && isReloading() {
+			c.Close()
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+}
+
+func (srv *Server) keepAliveListener(l *netListener) tcpKeepAliveListener {
+
+	period := srv.KeepAlivePeriod
+	if period == 0 {
+		period = defaultKeepAlivePeriod
+	}
+	return tcpKeepAliveListener{netListener: l, period: period}
+}
+
+func (srv *Server) manager() *Manager {
+
+	if srv.Manager == nil {
+		return defaultManager
+	}
+	return srv.Manager
+}
+
+func timeoutHandler(m *Manager, h http.Handler, timeout, drainTimeout time.Duration) http.Handler {
+
+	serving := http.TimeoutHandler(h, timeout, "")
+	if drainTimeout <= 0 || drainTimeout >= timeout {
+		return serving
+	}
+
+	draining := http.TimeoutHandler(h, drainTimeout, "")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if m.isClosed() {
+			draining.ServeHTTP(w, r)
+		} else {
+			serving.ServeHTTP(w, r)
+		}
+	})
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -52,12 +364,33 @@ func (srv *Server) ListenAndServe() error {
 		addr = ":http"
 	}
 
-	ln, err := NewListener("tcp", srv.Addr)
+	ln, err := srv.manager().NewListener("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	return srv.Serve(tcpKeepAliveListener{netListener:ln.(*netListener)})
+	l := ln.(*netListener)
+	l.plainHTTP = true
+	return srv.Serve(srv.keepAliveListener(l))
+}
+
+// ServeListener serves on a listener created by the caller, e.g. with custom socket
+// options like SO_REUSEPORT. the listener joins the manager of the server, it's
+// closed by the drain and its socket is passed to the child process on restart,
+// see Manager.WrapListener.
+func (srv *Server) ServeListener(l net.Listener) error {
+
+	n, err := srv.manager().wrapListener(l)
+	if err != nil {
+		return err
+	}
+
+	// the listeners wrapped by tls.NewListener must not get the plain 503.
+	switch l.(type) {
+	case *net.TCPListener, *net.UnixListener:
+		n.plainHTTP = true
+	}
+	return srv.Serve(n)
 }
 
 // ListenAndServeTLS listens on the TCP network address srv.Addr and
@@ -73,6 +406,10 @@ func (srv *Server) ListenAndServe() error {
 //
 // If srv.Addr is blank, ":https" is used.
 //
+// HTTP/2 is negotiated by ALPN with the http2 support of net/http, set
+// srv.TLSNextProto to a non-nil empty map to disable it. the server is served by
+// http.Server.ServeTLS, srv.TLSConfig is replaced by the config it serves.
+//
 // ListenAndServeTLS always returns a non-nil error.
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	addr := srv.Addr
@@ -80,40 +417,43 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 		addr = ":https"
 	}
 
-	// Setup HTTP/2 before srv.Serve, to initialize srv.TLSConfig
-	// before we clone it and create the TLS Listener.
-
-	// TODO: setup http2
-	//if err := srv.setupHTTP2_ListenAndServeTLS(); err != nil {
-	//	return err
-	//}
-
-	config := &tls.Config{}
-	err := deepCopy(config, srv.TLSConfig)
-	if err != nil {
-		return err
-	}
-	if !strSliceContains(config.NextProtos, "http/1.1") {
-		config.NextProtos = append(config.NextProtos, "http/1.1")
+	// Clone keeps the callbacks, e.g. GetCertificate for SNI or ACME.
+	config := srv.TLSConfig.Clone()
+	if config == nil {
+		config = &tls.Config{}
 	}
 
-	configHasCert := len(config.Certificates) > 0 || config.GetCertificate != nil
+	// the config may be replaced by SetTLSConfig at runtime.
+	config.GetConfigForClient = srv.configForClient(config.GetConfigForClient)
+	config.VerifyConnection = countHandshakes(config.VerifyConnection)
+
+	configHasCert := len(config.Certificates) > 0 || config.GetCertificate != nil || srv.cert.Load() != nil
 	if !configHasCert || certFile != "" || keyFile != "" {
-		var err error
-		config.Certificates = make([]tls.Certificate, 1)
-		config.Certificates[0], err = tls.LoadX509KeyPair(certFile, keyFile)
-		if err != nil {
+		if err := srv.ReloadCertificate(certFile, keyFile); err != nil {
 			return err
 		}
 	}
 
-	ln, err := NewListener("tcp", srv.Addr)
+	// the certificate may be replaced by ReloadCertificate at runtime, the
+	// static certificates would bypass GetCertificate.
+	if srv.cert.Load() != nil {
+		config.Certificates = nil
+		config.GetCertificate = srv.getCertificate(config.GetCertificate)
+	}
+
+	ln, err := srv.manager().NewListener("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{netListener:ln.(*netListener)}, config)
-	return srv.Serve(tlsListener)
+	// http.Server.ServeTLS sets up HTTP/2 and adds the served protocols to the
+	// NextProtos, http.Server.Serve only does if "h2" is already there.
+	srv.TLSConfig = config
+	srv.setup.Do(srv.setupHandler)
+
+	l := srv.keepAliveListener(ln.(*netListener))
+	ReturnOnDrain(l)
+	return srv.wait(srv.Server.ServeTLS(l, "", ""))
 }
 
 // ListenAndServe listens on the TCP network address addr
@@ -147,10 +487,11 @@ func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 //	 log.Fatal(err)
 // }
 //
+// use NewServer to hold the server, e.g. to stop it by application logic.
+//
 // ListenAndServe always returns a non-nil error.
 func ListenAndServe(addr string, handler http.Handler) error {
-	server := &Server{Server: &http.Server{Addr: addr, Handler: handler}}
-	return server.ListenAndServe()
+	return NewServer(addr, handler).ListenAndServe()
 }
 
 // ListenAndServeTLS acts identically to ListenAndServe, except that it
@@ -189,16 +530,7 @@ func ListenAndServe(addr string, handler http.Handler) error {
 //
 // ListenAndServeTLS always returns a non-nil error.
 func ListenAndServeTLS(addr, certFile, keyFile string, handler http.Handler) error {
-	server := &Server{Server: &http.Server{Addr: addr, Handler: handler}}
-	return server.ListenAndServeTLS(certFile, keyFile)
-}
-
-func deepCopy(dst, src interface{}) error {
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
-		return err
-	}
-	return gob.NewDecoder(bytes.NewBuffer(buf.Bytes())).Decode(dst)
+	return NewServer(addr, handler).ListenAndServeTLS(certFile, keyFile)
 }
 
 func strSliceContains(ss []string, s string) bool {
@@ -208,4 +540,16 @@ func strSliceContains(ss []string, s string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+
+func strSliceEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
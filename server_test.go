@@ -0,0 +1,240 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"io"
+	"net"
+	"bufio"
+	"time"
+	"testing"
+	"runtime"
+	"net/http"
+	"path/filepath"
+	"math/big"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/rand"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+)
+
+// selfSignedCert returns a certificate of 127.0.0.1.
+func selfSignedCert(t *testing.T) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grace test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// listenAndServe starts the server on a random port of a test manager by "serve",
+// and returns the address and the result of "serve".
+func listenAndServe(t *testing.T, srv *Server, serve func() error) (string, <-chan error) {
+
+	srv.Addr = "127.0.0.1:0"
+	srv.Manager = newTestManager(t)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if addrs := srv.Manager.ListenerAddrs(); len(addrs) > 0 {
+			return addrs[0].String(), served
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the server is not listening")
+	return "", nil
+}
+
+func listenAndServeTLS(t *testing.T, srv *Server) string {
+
+	addr, _ := listenAndServe(t, srv, func() error {
+		return srv.ListenAndServeTLS("", "")
+	})
+	return addr
+}
+
+// getProto requests the server by a client which attempts HTTP/2, and returns the
+// major version of the response.
+func getProto(t *testing.T, addr string) int {
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("https://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.ProtoMajor
+}
+
+func TestListenAndServeTLSHTTP2(t *testing.T) {
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cert := selfSignedCert(t)
+
+	// the user config doesn't list "h2".
+	srv := NewServer("", handler)
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"acme-tls/1"}}
+	if major := getProto(t, listenAndServeTLS(t, srv)); major != 2 {
+		t.Fatalf("HTTP/%d, want HTTP/2", major)
+	}
+
+	// the config installed at runtime is adjusted too.
+	srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if major := getProto(t, srv.Manager.ListenerAddrs()[0].String()); major != 2 {
+		t.Fatalf("HTTP/%d with the new config, want HTTP/2", major)
+	}
+
+	// HTTP/2 disabled.
+	srv = NewServer("", handler)
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	addr := listenAndServeTLS(t, srv)
+	if major := getProto(t, addr); major != 1 {
+		t.Fatalf("HTTP/%d, want HTTP/1.1", major)
+	}
+	srv.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+	if major := getProto(t, addr); major != 1 {
+		t.Fatalf("HTTP/%d with the new config, want HTTP/1.1", major)
+	}
+}
+
+func TestListenAndServeTLSGetCertificate(t *testing.T) {
+
+	cert := selfSignedCert(t)
+	names := make(chan string, 1)
+
+	srv := NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLSConfig = &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		names <- hello.ServerName
+		return &cert, nil
+	}}
+	addr := listenAndServeTLS(t, srv)
+
+	// the callback survives the config copy of ListenAndServeTLS.
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.test", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case name := <-names:
+		if name != "example.test" {
+			t.Fatalf("GetCertificate got server name %q", name)
+		}
+	default:
+		t.Fatal("GetCertificate is not called by the handshake")
+	}
+}
+
+type wrappedConn struct {
+	net.Conn
+}
+
+func TestKeepAliveListenerNonTCP(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix socket")
+	}
+
+	m := newTestManager(t)
+	srv := &Server{Server: &http.Server{}, Manager: m}
+
+	// a unix socket.
+	l, err := m.NewListener("unix", filepath.Join(t.TempDir(), "grace.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := acceptOne(t, srv.keepAliveListener(l.(*netListener)))
+	c.Close()
+
+	// a connection wrapped by the ConnWrapper without NetConn.
+	ConnWrapper(func(c net.Conn) net.Conn {
+		return wrappedConn{c}
+	})
+	defer ConnWrapper(nil)
+
+	l, err = m.NewListener("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = acceptOne(t, srv.keepAliveListener(l.(*netListener)))
+	c.Close()
+}
+
+func TestServerStopClosesIdleConns(t *testing.T) {
+
+	srv := NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr, served := listenAndServe(t, srv, srv.ListenAndServe)
+
+	// a keep-alive connection, idle after the response.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: grace\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.Stop()
+	}()
+
+	// Shutdown closes the idle connection, the drain doesn't wait for it.
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop is waiting for the idle connection")
+	}
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %d bytes from the idle connection: %v", n, err)
+	}
+
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Fatalf("ListenAndServe() = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe doesn't return after Stop")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"sync/atomic"
+)
+
+// State is the lifecycle state of the process.
+type State string
+
+const (
+	StateServing    State = "serving"
+	StateRestarting State = "restarting"
+	StateDraining   State = "draining"
+	StateReloading  State = "reloading"
+)
+
+// ProcessInfo is a read-only snapshot of the process, it can be encoded to JSON
+// directly, e.g. for an admin endpoint.
+type ProcessInfo struct {
+	PID       int  `json:"pid"`
+	ParentPID int  `json:"parent_pid"`
+	IsChild   bool `json:"is_child"`
+
+	// how many graceful restarts happened before the process started.
+	Generation int `json:"generation"`
+
+	// addresses of the sockets inherited from the parent process.
+	InheritedAddrs []string `json:"inherited_addrs"`
+
+	// addresses of the graceful listeners.
+	ListenerAddrs []string `json:"listener_addrs"`
+
+	ActiveConns  int64 `json:"active_conns"`
+	DroppedConns int64 `json:"dropped_conns"`
+	State        State `json:"state"`
+
+	BeforeCloseCalls int `json:"before_close_calls"`
+	AfterCloseCalls  int `json:"after_close_calls"`
+	Flushers         int `json:"flushers"`
+}
+
+// Snapshot returns the current state of the process.
+func Snapshot() ProcessInfo {
+
+	info := ProcessInfo{
+		PID:          pid,
+		ParentPID:    parentPID,
+		IsChild:      isChildProcess,
+		Generation:   generation,
+		ActiveConns:  atomic.LoadInt64(&activeConns),
+		DroppedConns: DroppedConns(),
+		State:        currentState(),
+	}
+
+	beforeCalls, afterCalls, listeners := defaultManager.closeCalls()
+	info.BeforeCloseCalls = len(beforeCalls)
+	info.AfterCloseCalls = len(afterCalls)
+	info.ListenerAddrs = make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		info.ListenerAddrs = append(info.ListenerAddrs, l.Addr().String())
+	}
+
+	flushersLock.Lock()
+	info.Flushers = len(flushers)
+	flushersLock.Unlock()
+
+	socketLock.Lock()
+	info.InheritedAddrs = append([]string{}, inheritedAddrs...)
+	socketLock.Unlock()
+
+	return info
+}
+
+func currentState() State {
+
+	if atomic.LoadInt32(&restarting) == 1 {
+		return StateRestarting
+	}
+
+	if isClosed() {
+		return StateDraining
+	}
+
+	if isReloading() {
+		return StateReloading
+	}
+	return StateServing
+}
@@ -0,0 +1,51 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// queue length of TCP Fast Open, 0 means disabled.
+var tcpFastOpen int
+
+// TCPFastOpen enables TCP Fast Open on the TCP listeners created by NewListener
+// with the given queue length, 0 disables it. it must be called before the
+// listeners created.
+//
+// only Linux is supported, it's ignored on other platforms. the option is set on
+// the socket, so the sockets inherited by the child processes keep it.
+func TCPFastOpen(queueLen int) {
+
+	tcpFastOpen = queueLen
+}
+
+// listen creates a net listener with the socket options.
+func listen(network, addr string) (net.Listener, error) {
+
+	lc := net.ListenConfig{Control: controlSocket}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+func controlSocket(network, address string, c syscall.RawConn) error {
+
+	// the child process binds the addresses before the parent process closes
+	// its listeners.
+	if !osSupportSocketFile && reuseSupported {
+		if err := setReuseAddr(c); err != nil {
+			return err
+		}
+	}
+
+	if tcpFastOpen > 0 && strings.HasPrefix(network, "tcp") {
+		if err := setTCPFastOpen(c, tcpFastOpen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
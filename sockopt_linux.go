@@ -0,0 +1,24 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"syscall"
+)
+
+// TCP_FASTOPEN, see linux/tcp.h.
+const tcpFastOpenOpt = 0x17
+
+func setTCPFastOpen(c syscall.RawConn, queueLen int) error {
+
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenOpt, queueLen)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
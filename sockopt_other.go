@@ -0,0 +1,18 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package grace
+
+import (
+	"syscall"
+)
+
+// TCP Fast Open is not supported, ignore it.
+func setTCPFastOpen(c syscall.RawConn, queueLen int) error {
+
+	return nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !386 && !amd64 && !arm)
+// +build aix darwin dragonfly freebsd netbsd openbsd linux,!386,!amd64,!arm
+
+package grace
+
+import (
+	"syscall"
+)
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,12 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build 386 || amd64 || arm
+// +build 386 amd64 arm
+
+package grace
+
+// SO_REUSEPORT, see asm-generic/socket.h, it's missing in package syscall on
+// these architectures.
+const soReusePort = 0xf
@@ -0,0 +1,125 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Spawner starts the child process, "path" is the executable file, "args" are the
+// arguments without the program name, "env" is the environment, and "files" are
+// the extra files which must be passed to the child process from fd 3 in order.
+type Spawner interface {
+	Spawn(path string, args, env []string, files []*os.File) (*os.Process, error)
+}
+
+// SpawnerFunc adapts a function to a Spawner, e.g. to wrap the child process in
+// "nohup" or add env vars:
+//
+//	grace.SetSpawner(grace.SpawnerFunc(func(path string, args, env []string, files []*os.File) (*os.Process, error) {
+//		cmd := exec.Command("nohup", append([]string{path}, args...)...)
+//		cmd.Env = append(env, "APP_RESTARTED=1")
+//		cmd.ExtraFiles = files
+//		if err := cmd.Start(); err != nil {
+//			return nil, err
+//		}
+//		return cmd.Process, nil
+//	}))
+type SpawnerFunc func(path string, args, env []string, files []*os.File) (*os.Process, error)
+
+// Spawn calls f(path, args, env, files).
+func (f SpawnerFunc) Spawn(path string, args, env []string, files []*os.File) (*os.Process, error) {
+
+	return f(path, args, env, files)
+}
+
+var spawner = struct {
+	Spawner
+	sync.Mutex
+}{Spawner: execSpawner{}}
+
+// SetSpawner replaces how the child process is started, e.g. in a sandboxed
+// environment where exec is mediated through a broker, or a fake spawner in tests.
+// nil restores the default spawner, which uses os/exec.
+func SetSpawner(s Spawner) {
+	spawner.Lock()
+	defer spawner.Unlock()
+
+	if s == nil {
+		s = execSpawner{}
+	}
+	spawner.Spawner = s
+}
+
+func getSpawner() Spawner {
+	spawner.Lock()
+	defer spawner.Unlock()
+
+	return spawner.Spawner
+}
+
+// execSpawner starts the child process by os/exec, the child process shares the
+// standard input and outputs of the current process.
+type execSpawner struct{}
+
+func (execSpawner) Spawn(path string, args, env []string, files []*os.File) (*os.Process, error) {
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Env = env
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+// reapProcess waits for the child process in the background, so it won't become a
+// zombie if the current process lives on after the restart, e.g. the restart
+// failed, the exit status is logged. the returned channel receives the state after
+// the child process exited. it has no effect on the normal handoff, the waiting
+// ends with the current process.
+func reapProcess(p *os.Process) <-chan *os.ProcessState {
+
+	exited := make(chan *os.ProcessState, 1)
+	go func() {
+		state, err := p.Wait()
+		if err != nil {
+			logf("wait new process failed! %v\n", err)
+			return
+		}
+		logf("new process %d exited: %v\n", p.Pid, state)
+		exited <- state
+	}()
+	return exited
+}
+
+// dedupEnv removes the duplicated env vars, the last one wins.
+func dedupEnv(env []string) []string {
+
+	index := make(map[string]int, len(env))
+	var result []string
+	for _, kv := range env {
+
+		k := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			k = kv[:i]
+		}
+
+		if i, ok := index[k]; ok {
+			result[i] = kv
+			continue
+		}
+		index[k] = len(result)
+		result = append(result, kv)
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+type status struct {
+	Status    State  `json:"status"`
+	Remaining *int64 `json:"remaining,omitempty"`
+}
+
+// StatusHandler returns a http handler which reports the process state in JSON,
+// it fits load balancer health checks, deploy tools and human inspection:
+//
+//	serving:    200 {"status":"serving"}
+//	restarting: 200 {"status":"restarting"}
+//	draining:   503 {"status":"draining","remaining":N}
+//
+// "remaining" is the number of the opened connects. e.g.:
+//
+//	http.Handle("/status", grace.StatusHandler())
+func StatusHandler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		s := status{Status: currentState()}
+		code := http.StatusOK
+		if s.Status == StateDraining {
+			remaining := atomic.LoadInt64(&activeConns)
+			s.Remaining = &remaining
+			code = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(s)
+	})
+}
+
+// IsDraining reports whether the process started draining, i.e. it stopped accepting
+// new connects for a stop or a restart. the flag is set before the BeforeCloseCall
+// callbacks run and the listeners are closed.
+func IsDraining() bool {
+
+	return defaultManager.IsDraining()
+}
+
+// IsDraining acts like the package function IsDraining.
+func (m *Manager) IsDraining() bool {
+
+	return m.isClosed()
+}
+
+// DrainAwareHealthHandler wraps a health check handler, it responds "503 Service
+// Unavailable" once the process started draining, so the load balancer stops
+// routing new requests to it, e.g. a Kubernetes readiness probe:
+//
+//	http.Handle("/ready", grace.DrainAwareHealthHandler(readyHandler))
+//
+// a nil "next" responds "200 OK" while serving.
+func DrainAwareHealthHandler(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if IsDraining() {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+
+		if next == nil {
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+
+	// number of the connects accepted during the process lifetime.
+	totalConns int64
+
+	// why the process exits, e.g. "signal: terminated", "file", "admin".
+	exitReason = struct {
+		reason string
+		sync.Mutex
+	}{}
+)
+
+// setExitReason records why the process is going to stop or restart, it
+// should be called before Stop or Restart.
+func setExitReason(reason string) {
+	exitReason.Lock()
+	defer exitReason.Unlock()
+
+	exitReason.reason = reason
+}
+
+func getExitReason() string {
+	exitReason.Lock()
+	defer exitReason.Unlock()
+
+	if exitReason.reason == "" {
+		return "manual"
+	}
+	return exitReason.reason
+}
+
+// logSummary logs the lifecycle summary of the process, it's called just before
+// the process exited.
+func logSummary(drain time.Duration) {
+
+	logf(
+		"shutdown summary: uptime=%s conns=%d restarts=%d drain=%s reason=%s\n",
+		time.Since(startTime).Round(time.Millisecond),
+		atomic.LoadInt64(&totalConns),
+		generation,
+		drain.Round(time.Millisecond),
+		getExitReason(),
+	)
+}
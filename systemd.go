@@ -0,0 +1,139 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the systemd socket activation protocol, the sockets start from fd 3.
+const (
+	envSystemdFDs   = "LISTEN_FDS"
+	envSystemdPID   = "LISTEN_PID"
+	envSystemdNames = "LISTEN_FDNAMES"
+)
+
+// aliases of the systemd sockets, maps the names in "LISTEN_FDNAMES" to the
+// local addresses of the sockets, guarded by socketLock.
+var systemdNames = make(map[string]string)
+
+// inheritSystemdSockets adopts the sockets passed by systemd socket activation, it
+// reports whether the process was activated by systemd.
+//
+// the sockets are matched with the "addr" of NewListener(or NewPacketConn) by the
+// "FileDescriptorName=" of the socket unit, or by the local address, e.g. ":8080"
+// matches the socket listening on "[::]:8080".
+func inheritSystemdSockets() bool {
+
+	n, err := strconv.Atoi(os.Getenv(envSystemdFDs))
+	if err != nil || n <= 0 || os.Getenv(envSystemdPID) != strconv.Itoa(pid) {
+		return false
+	}
+
+	var names []string
+	if v := os.Getenv(envSystemdNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	// the processes started by the application are not activated.
+	os.Unsetenv(envSystemdFDs)
+	os.Unsetenv(envSystemdPID)
+	os.Unsetenv(envSystemdNames)
+
+	index := make(map[string]uintptr, n)
+	files := make(map[string]*os.File, n)
+	for i := 0; i < n; i++ {
+
+		fd := uintptr(3 + i)
+		f := os.NewFile(fd, "")
+		key, err := socketKey(f)
+		if err != nil {
+			logf("inspect systemd socket %d failed! %v\n", fd, err)
+			continue
+		}
+		index[key] = fd
+		files[key] = f
+
+		if i < len(names) && names[i] != "" {
+			systemdNames[names[i]] = key
+		}
+	}
+
+	logf("activated by systemd, %d sockets.\n", len(index))
+	inheritFiles(index, files)
+	return true
+}
+
+// socketKey returns the local address of the socket, the address of a packet
+// socket is prefixed, see NewPacketConn.
+func socketKey(f *os.File) (string, error) {
+
+	// the file is duplicated by FileListener, the original one is kept open.
+	l, err := net.FileListener(f)
+	if err == nil {
+		defer l.Close()
+		return l.Addr().String(), nil
+	}
+
+	c, perr := net.FilePacketConn(f)
+	if perr != nil {
+		return "", err
+	}
+	defer c.Close()
+	return packetAddrPrefix + c.LocalAddr().String(), nil
+}
+
+// systemdKey returns the key of the unclaimed systemd socket which matches "addr",
+// or "" if none matches. the caller must hold the socketLock.
+func systemdKey(addr string) string {
+
+	if key, ok := systemdNames[addr]; ok {
+		return key
+	}
+
+	prefix := ""
+	if strings.HasPrefix(addr, packetAddrPrefix) {
+		prefix = packetAddrPrefix
+		addr = addr[len(prefix):]
+	}
+
+	for key := range unclaimed {
+		if strings.HasPrefix(key, prefix) && sameHostPort(addr, key[len(prefix):]) {
+			return key
+		}
+	}
+	return ""
+}
+
+// sameHostPort reports whether the two "host:port" addresses are the same socket
+// address, an empty or unspecified host matches any unspecified host.
+func sameHostPort(a, b string) bool {
+
+	ah, ap, err := net.SplitHostPort(a)
+	if err != nil {
+		return a == b
+	}
+	bh, bp, err := net.SplitHostPort(b)
+	if err != nil || ap != bp {
+		return false
+	}
+
+	unspecified := func(h string) bool {
+		ip := net.ParseIP(h)
+		return h == "" || ip != nil && ip.IsUnspecified()
+	}
+	if unspecified(ah) || unspecified(bh) {
+		return unspecified(ah) && unspecified(bh)
+	}
+
+	aip, bip := net.ParseIP(ah), net.ParseIP(bh)
+	if aip != nil && bip != nil {
+		return aip.Equal(bip)
+	}
+	return ah == bh
+}
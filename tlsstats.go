@@ -0,0 +1,54 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// TLSStats counts the TLS handshakes of the graceful https servers.
+type TLSStats struct {
+
+	// handshakes resumed from a previous session.
+	Resumed int64 `json:"resumed"`
+
+	// full handshakes.
+	Full int64 `json:"full"`
+}
+
+var tlsStats TLSStats
+
+// TLSHandshakeStats returns the numbers of the resumed and full TLS handshakes of
+// the servers started by ListenAndServeTLS. a high resumption rate after a restart
+// confirms the sessions survive the restart.
+func TLSHandshakeStats() TLSStats {
+
+	return TLSStats{
+		Resumed: atomic.LoadInt64(&tlsStats.Resumed),
+		Full:    atomic.LoadInt64(&tlsStats.Full),
+	}
+}
+
+// countHandshakes returns a VerifyConnection callback which counts the succeeded
+// handshakes, "next" is the original callback.
+func countHandshakes(next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+
+	return func(cs tls.ConnectionState) error {
+
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+
+		if cs.DidResume {
+			atomic.AddInt64(&tlsStats.Resumed, 1)
+		} else {
+			atomic.AddInt64(&tlsStats.Full, 1)
+		}
+		return nil
+	}
+}
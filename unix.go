@@ -0,0 +1,51 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// unixSocketPath returns the path of the unix socket file, or "" for the other
+// networks and the abstract sockets.
+func unixSocketPath(netType, addr string) string {
+
+	if !strings.HasPrefix(netType, "unix") || strings.HasPrefix(addr, "@") {
+		return ""
+	}
+	return addr
+}
+
+// removeStaleUnixSocket removes the socket file left by a crashed process, so the
+// address can be bound again. a socket file which still accepts connects is kept.
+func removeStaleUnixSocket(netType, path string) {
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	c, err := net.DialTimeout(netType, path, time.Second)
+	if err == nil {
+		c.Close()
+		return
+	}
+
+	logf("remove stale unix socket: %s\n", path)
+	os.Remove(path)
+}
+
+// keepUnixSocket keeps the socket file when the listener closed, the child process
+// inherits the socket and needs the file, it's removed on the final stop, see
+// netListener.Close.
+func keepUnixSocket(l net.Listener) {
+
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+}
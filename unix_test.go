@@ -0,0 +1,40 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"fmt"
+	"time"
+	"runtime"
+	"testing"
+)
+
+func TestRestartAbstractSocket(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are linux only")
+	}
+
+	addr := fmt.Sprintf("@grace-test-%d-%d", pid, time.Now().UnixNano())
+	report := realRestart(t, "unix|"+addr)
+
+	m := newTestManager(t)
+	l, err := m.NewListener("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := readReport(t, report, 1)
+	if !strSliceContains(child.Inherited, addr) {
+		t.Fatalf("%s is not inherited: %v", addr, child.Inherited)
+	}
+	if got := child.Addrs[addr]; got != l.Addr().String() {
+		t.Fatalf("child process bound %s, want %s", got, l.Addr())
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+type unixPerm struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+var (
+	unixPerms     = make(map[string]unixPerm)
+	unixPermsLock sync.Mutex
+)
+
+// UnixSocketPerm sets the permissions and the owner of the unix socket file created
+// by NewListener for "addr", so only the expected users can connect. "uid" or "gid"
+// -1 keeps the owner unchanged. it must be called before NewListener.
+//
+// the child process inherits the socket file with its permissions, NewListener
+// verifies them in the child process instead, if they drifted(e.g. the file was
+// changed by hand, or a deploy changed the intended permissions), a warning is
+// logged and the expected permissions are applied again.
+func UnixSocketPerm(addr string, mode os.FileMode, uid, gid int) {
+
+	unixPermsLock.Lock()
+	defer unixPermsLock.Unlock()
+
+	unixPerms[addr] = unixPerm{mode: mode.Perm(), uid: uid, gid: gid}
+}
+
+func lookupUnixPerm(netType, addr string) (unixPerm, bool) {
+
+	// abstract sockets have no file.
+	if !strings.HasPrefix(netType, "unix") || strings.HasPrefix(addr, "@") {
+		return unixPerm{}, false
+	}
+
+	unixPermsLock.Lock()
+	defer unixPermsLock.Unlock()
+
+	perm, ok := unixPerms[addr]
+	return perm, ok
+}
+
+// applyUnixPerm sets the permissions of a new unix socket file.
+func applyUnixPerm(netType, addr string) error {
+
+	perm, ok := lookupUnixPerm(netType, addr)
+	if !ok {
+		return nil
+	}
+
+	if err := os.Chmod(addr, perm.mode); err != nil {
+		return err
+	}
+
+	if perm.uid != -1 || perm.gid != -1 {
+		return os.Chown(addr, perm.uid, perm.gid)
+	}
+	return nil
+}
+
+// verifyUnixPerm checks the permissions of an inherited unix socket file.
+func verifyUnixPerm(netType, addr string) {
+
+	perm, ok := lookupUnixPerm(netType, addr)
+	if !ok {
+		return
+	}
+
+	fi, err := os.Stat(addr)
+	if err != nil {
+		logf("WARNING: verify unix socket %s failed! %v\n", addr, err)
+		return
+	}
+
+	uid, gid, _ := fileOwner(fi)
+	if fi.Mode().Perm() == perm.mode &&
+		(perm.uid == -1 || perm.uid == uid) &&
+		(perm.gid == -1 || perm.gid == gid) {
+		return
+	}
+
+	logf(
+		"WARNING: unix socket %s permissions drifted, expected %v %d:%d, got %v %d:%d\n",
+		addr, perm.mode, perm.uid, perm.gid, fi.Mode().Perm(), uid, gid,
+	)
+
+	if err := applyUnixPerm(netType, addr); err != nil {
+		logf("apply unix socket %s permissions failed! %v\n", addr, err)
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+)
+
+// the file owner is not available on windows.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+
+	return -1, -1, false
+}
@@ -0,0 +1,657 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"io"
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+	"crypto/sha256"
+	"path/filepath"
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// number of the consecutive failed restarts.
+	failedRestarts int32
+
+	// automatic restarts stop after the number of consecutive failed restarts.
+	maxFailedRestarts int32 = 5
+)
+
+// MaxFailedRestarts sets the number of consecutive failed restarts, after which the
+// file watcher stops restarting the process automatically, so a bad executable file
+// won't cause endless restart attempts. the process needs to be restarted manually
+// (by signal or Restart()) then. the default is 5, 0 means unlimited.
+func MaxFailedRestarts(n int) {
+
+	atomic.StoreInt32(&maxFailedRestarts, int32(n))
+}
+
+// FailedRestarts returns the number of the consecutive failed restarts, it's reset
+// after a restart succeeded. e.g. alert if it's not 0, the automatic restarts stop
+// at the limit of MaxFailedRestarts, the current process keeps serving.
+func FailedRestarts() int {
+
+	return int(atomic.LoadInt32(&failedRestarts))
+}
+
+// autoRestartDisabled reports whether too many restarts failed.
+func autoRestartDisabled() bool {
+
+	max := atomic.LoadInt32(&maxFailedRestarts)
+	return max > 0 && atomic.LoadInt32(&failedRestarts) >= max
+}
+
+var (
+	// the file watcher doesn't restart the process more often than this, in
+	// nanoseconds.
+	minRestartInterval = int64(5 * time.Second)
+
+	// time of the last failed restart in unix nanoseconds.
+	lastRestart int64
+)
+
+// MinRestartInterval sets the minimum interval between the automatic restarts,
+// counted from the last restart, i.e. the start of the current process if it was
+// started by a restart, or the last failed restart. a file change within the
+// interval postpones the restart until the interval passed, so a build system
+// touching the executable file repeatedly won't restart the process in a loop.
+// the restarts by signal or Restart() are not limited. the default is 5 seconds, 0
+// disables the limit.
+func MinRestartInterval(d time.Duration) {
+
+	atomic.StoreInt64(&minRestartInterval, int64(d))
+}
+
+// restartCooldown returns how long the automatic restart must wait, see
+// MinRestartInterval.
+func restartCooldown() time.Duration {
+
+	last := atomic.LoadInt64(&lastRestart)
+	if generation > 0 && startTime.UnixNano() > last {
+		last = startTime.UnixNano()
+	}
+	if last == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&minRestartInterval)) - time.Since(time.Unix(0, last))
+}
+
+// watchDelay is the debounce window of the executable file events in nanoseconds.
+var watchDelay = int64(time.Second)
+
+// SetWatchDelay sets how long the executable file must stay unchanged before the
+// automatic restart, each file event restarts the window, and the file size must
+// be the same at both ends of the window, so a slow linker writing the executable
+// in bursts won't trigger a restart against a truncated file. the default is 1
+// second.
+func SetWatchDelay(d time.Duration) {
+
+	atomic.StoreInt64(&watchDelay, int64(d))
+}
+
+// watchExe reports whether ListenSignal watches the executable file.
+var watchExe = true
+
+// WatchExecutable enables or disables the executable file watcher of ListenSignal,
+// the signals still work if it's disabled. it's enabled by default, but production
+// deployments should usually disable it, a backup job or an antivirus touching the
+// executable file may trigger an unwanted restart, restart by signal or Restart()
+// instead. it must be called before ListenSignal.
+func WatchExecutable(enable bool) {
+
+	watchExe = enable
+}
+
+// watchDir reports whether ListenSignal watches the directories of the
+// executable file instead of the file itself.
+var watchDir bool
+
+// WatchDirectory makes ListenSignal watch the directory of the executable file,
+// and the directories holding every symlink on the executable's path, instead
+// of watching the executable file itself. it must be called before ListenSignal.
+//
+// some deploy flows(e.g. Capistrano-style releases) replace the executable by
+// swapping a whole directory symlink, the executable file itself never changes
+// so the file watcher misses the deploy. in directory mode every relevant event
+// re-resolves the symlinks, and a new target triggers the restart.
+func WatchDirectory(enable bool) {
+
+	watchDir = enable
+}
+
+// files watched besides the executable file, see WatchFiles.
+var extraFiles = &watchedFiles{hashes: make(map[string][]byte)}
+
+// WatchFiles adds files to the file watcher of ListenSignal, e.g. the config
+// files, the TLS certificates or the templates, a change to any of them restarts
+// the process gracefully, the same as a new executable file. the events share the
+// debounce window of SetWatchDelay. it must be called before ListenSignal, and it
+// works even if WatchExecutable is disabled.
+//
+// editors often save a file by writing a new one and renaming it over the old one,
+// the file is watched again after it was renamed or removed.
+func WatchFiles(paths ...string) error {
+
+	for _, path := range paths {
+		if err := extraFiles.add(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchExecutable watches the executable file(unless WatchExecutable is
+// disabled) and the files added by WatchFiles, and restarts the process through
+// the manager when the file content changed.
+func watchExecutable(m *Manager) (err error) {
+
+	var exe *executable
+	if watchExe {
+
+		// watch the executable file of the child process, os.Args[0] may be a
+		// relative path or a name found in $PATH.
+		path, err := execPath()
+		if err != nil {
+			return err
+		}
+
+		exe, err = newExecutable(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	m.BeforeCloseCall(func() {
+
+		watcher.Close()
+	})
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	go func() {
+
+		for {
+			select {
+			case evt, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if (exe != nil && exe.changed(evt)) || extraFiles.changed(evt) {
+					timer.Reset(time.Duration(atomic.LoadInt64(&watchDelay)))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				if err != nil {
+					logf("grace.ListenSignal(): %v\n", err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+
+		for {
+			<-timer.C
+
+			// the renamed or removed files may not be replaced yet, try again
+			// in another window.
+			if !extraFiles.rewatch(watcher) || (exe != nil && !exe.rewatch(watcher)) {
+				timer.Reset(time.Duration(atomic.LoadInt64(&watchDelay)))
+				continue
+			}
+
+			// restarted recently, wait until the interval passed.
+			if d := restartCooldown(); d > 0 {
+				logf("restarted recently, delay the restart for %s.\n", d.Round(time.Millisecond))
+				timer.Reset(d)
+				continue
+			}
+
+			// the file is still being written, wait for another window.
+			if exe != nil && !exe.stable() {
+				timer.Reset(time.Duration(atomic.LoadInt64(&watchDelay)))
+				continue
+			}
+
+			// only restart if the content was changed, check all files.
+			files := extraFiles.modified()
+			var hash []byte
+			if exe != nil {
+				hash = exe.modified()
+			}
+			if len(files) == 0 && hash == nil {
+				continue
+			}
+
+			if autoRestartDisabled() {
+				logf(
+					"ERROR: %d consecutive restarts failed, automatic restart is disabled, "+
+						"please restart the process manually!\n",
+					atomic.LoadInt32(&failedRestarts),
+				)
+				continue
+			}
+
+			setExitReason("file")
+			if err := m.Restart(); err != nil {
+
+				// the changes are not recorded, the restart is retried after
+				// the cooldown, see MaxFailedRestarts.
+				if err != ErrRestartInProgress && !m.isClosed() {
+					timer.Reset(time.Duration(atomic.LoadInt64(&watchDelay)))
+				}
+				continue
+			}
+			extraFiles.commit(files)
+			if exe != nil {
+				exe.commit(hash)
+			}
+		}
+	}()
+
+	var paths []string
+	if exe != nil {
+		paths = exe.watchPaths()
+	}
+	for _, path := range append(paths, extraFiles.paths...) {
+		err = watcher.Add(path)
+		if err != nil {
+			logf("grace.ListenSignal(): %v\n", err)
+		}
+	}
+	return nil
+}
+
+// watchedFiles keeps the files added by WatchFiles.
+type watchedFiles struct {
+
+	// absolute paths of the files.
+	paths []string
+
+	// content hashes of the files.
+	hashes map[string][]byte
+
+	// the watched files, a file replaced by a rename must be watched again.
+	files map[string]os.FileInfo
+
+	// the files which were renamed or removed, they must be added to the file
+	// watcher again.
+	lost map[string]bool
+
+	sync.Mutex
+}
+
+func (w *watchedFiles) add(name string) error {
+
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return err
+	}
+
+	hash, err := fileHash(path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if _, ok := w.hashes[path]; !ok {
+		w.paths = append(w.paths, path)
+	}
+	w.hashes[path] = hash
+	if w.files == nil {
+		w.files = make(map[string]os.FileInfo)
+	}
+	w.files[path] = fi
+	return nil
+}
+
+// changed reports whether the file event may have changed a watched file.
+func (w *watchedFiles) changed(evt fsnotify.Event) bool {
+
+	w.Lock()
+	defer w.Unlock()
+
+	name := filepath.Clean(evt.Name)
+	if _, ok := w.hashes[name]; !ok {
+		return false
+	}
+
+	// the watch is gone with the old file.
+	if evt.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+		if w.lost == nil {
+			w.lost = make(map[string]bool)
+		}
+		w.lost[name] = true
+	}
+	return true
+}
+
+// rewatch adds the renamed, removed or replaced files to the file watcher again,
+// it reports whether all of them were added.
+func (w *watchedFiles) rewatch(watcher *fsnotify.Watcher) bool {
+
+	w.Lock()
+	defer w.Unlock()
+
+	for _, path := range w.paths {
+		if !w.lost[path] && !replaced(path, w.files[path]) {
+			continue
+		}
+
+		fi, err := readd(watcher, path)
+		if err != nil {
+			if w.lost == nil {
+				w.lost = make(map[string]bool)
+			}
+			w.lost[path] = true
+			continue
+		}
+		w.files[path] = fi
+		delete(w.lost, path)
+	}
+	return len(w.lost) == 0
+}
+
+// modified returns the new content hashes of the watched files which were changed
+// since the last restart, the missing files are skipped. the hashes are recorded
+// by commit after the restart succeeded.
+func (w *watchedFiles) modified() map[string][]byte {
+
+	w.Lock()
+	defer w.Unlock()
+
+	var modified map[string][]byte
+	for _, path := range w.paths {
+		hash, err := fileHash(path)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(hash, w.hashes[path]) {
+			logf("watched file changed: %s\n", path)
+			if modified == nil {
+				modified = make(map[string][]byte)
+			}
+			modified[path] = hash
+		}
+	}
+	return modified
+}
+
+// commit records the content hashes returned by modified.
+func (w *watchedFiles) commit(hashes map[string][]byte) {
+
+	w.Lock()
+	defer w.Unlock()
+
+	for path, hash := range hashes {
+		w.hashes[path] = hash
+	}
+}
+
+// replaced reports whether the file at "path" is not the watched file "fi" any
+// more, e.g. a new file was renamed over it. the watch follows the old file, the
+// rename only sends a Chmod event(the link count changed) if the old file is
+// still open, e.g. a running executable.
+func replaced(path string, fi os.FileInfo) bool {
+
+	cur, err := os.Stat(path)
+	return err == nil && fi != nil && !os.SameFile(cur, fi)
+}
+
+// readd watches the file at "path" again and returns the file watched now.
+func readd(watcher *fsnotify.Watcher, path string) (os.FileInfo, error) {
+
+	watcher.Remove(path)
+	if err := watcher.Add(path); err != nil {
+		if !os.IsNotExist(err) {
+			logf("grace.ListenSignal(): %v\n", err)
+		}
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+// executable keeps the path of the executable file that the file watcher is
+// interested in.
+type executable struct {
+
+	// absolute path of the executable, may contain symlinks.
+	path string
+
+	// path with all symlinks resolved.
+	target string
+
+	// content hash of the target, tools may touch or rewrite the executable
+	// without changing any byte.
+	hash []byte
+
+	// size of the target at the last change, see stable.
+	size int64
+
+	// the executable file was renamed or removed, e.g. replaced by an atomic
+	// save, its watch must be added again.
+	lost bool
+
+	// the watched executable file, see replaced.
+	file os.FileInfo
+
+	sync.Mutex
+}
+
+func newExecutable(name string) (*executable, error) {
+
+	path, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := fileHash(target)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &executable{path: path, target: target, hash: hash, file: file}, nil
+}
+
+func fileHash(name string) ([]byte, error) {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// watchPaths returns the paths should be added to the file watcher.
+func (e *executable) watchPaths() []string {
+
+	if !watchDir {
+		return []string{e.path}
+	}
+
+	paths := []string{filepath.Dir(e.path)}
+
+	// every symlink on the path may be swapped by a deploy, so watch the
+	// directories holding them too.
+	for p := e.path; p != filepath.Dir(p); p = filepath.Dir(p) {
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		dir := filepath.Dir(p)
+		if !strSliceContains(paths, dir) {
+			paths = append(paths, dir)
+		}
+	}
+	return paths
+}
+
+// changed reports whether the file event may have changed the executable file.
+func (e *executable) changed(evt fsnotify.Event) bool {
+
+	e.Lock()
+	defer e.Unlock()
+
+	if !watchDir {
+
+		// the watch is gone with the old file, the new file is watched again
+		// by rewatch.
+		if evt.Op&(fsnotify.Rename|fsnotify.Remove) != 0 {
+			e.lost = true
+		}
+		if evt.Op&(fsnotify.Chmod|fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+			e.size = fileSize(e.target)
+			return true
+		}
+		return false
+	}
+
+	// re-resolve the symlinks, the event may come from a swapped symlink
+	// which has nothing to do with the event's name.
+	target, err := filepath.EvalSymlinks(e.path)
+	if err != nil {
+
+		// the symlink may be in the middle of swapping, wait for the
+		// next event.
+		return false
+	}
+
+	if target != e.target {
+		e.target = target
+		e.size = fileSize(target)
+		return true
+	}
+
+	name := filepath.Clean(evt.Name)
+	if name != e.path && name != e.target {
+		return false
+	}
+
+	if evt.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) == 0 {
+		return false
+	}
+	e.size = fileSize(e.target)
+	return true
+}
+
+// rewatch adds the replaced executable file to the file watcher again, it reports
+// false if the new file is not there yet.
+func (e *executable) rewatch(watcher *fsnotify.Watcher) bool {
+
+	e.Lock()
+	defer e.Unlock()
+
+	// the directories are watched instead.
+	if watchDir {
+		return true
+	}
+
+	if !e.lost && !replaced(e.path, e.file) {
+		return true
+	}
+
+	fi, err := readd(watcher, e.path)
+	if err != nil {
+		e.lost = true
+		return false
+	}
+	e.file = fi
+	e.lost = false
+	return true
+}
+
+// stable reports whether the size of the executable file is the same as at the
+// last change.
+func (e *executable) stable() bool {
+
+	e.Lock()
+	defer e.Unlock()
+
+	size := fileSize(e.target)
+	if size != e.size {
+		logf("executable file is still being written, delay the restart.\n")
+		e.size = size
+		return false
+	}
+	return true
+}
+
+// fileSize returns the size of the file, or -1 if it can't be stat.
+func fileSize(name string) int64 {
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+// modified returns the new content hash of the executable file if it was changed
+// since the last restart, or nil. the hash is recorded by commit after the restart
+// succeeded, so a failed restart is retried.
+func (e *executable) modified() []byte {
+
+	e.Lock()
+	defer e.Unlock()
+
+	hash, err := fileHash(e.target)
+	if err != nil {
+		logf("hash executable file failed! %v\n", err)
+		return nil
+	}
+
+	if bytes.Equal(hash, e.hash) {
+		logf("executable file content unchanged, skip restart.\n")
+		return nil
+	}
+	return hash
+}
+
+// commit records the content hash returned by modified.
+func (e *executable) commit(hash []byte) {
+
+	e.Lock()
+	defer e.Unlock()
+
+	e.hash = hash
+}
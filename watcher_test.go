@@ -0,0 +1,203 @@
+// Copyright 2016 orivil Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package grace
+
+import (
+	"os"
+	"time"
+	"errors"
+	"os/exec"
+	"runtime"
+	"testing"
+	"io/ioutil"
+	"sync/atomic"
+	"path/filepath"
+	"gopkg.in/orivil/grace.v1/internal/testhook"
+)
+
+// copyExecutable copies the executable file "from" to "to" with the extra bytes
+// appended, so the new file has a different content but still runs.
+func copyExecutable(t *testing.T, from, to string, extra []byte) {
+
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(to, append(data, extra...), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchFromAnotherDirectory(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("a running executable file can't be replaced on windows")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	app := filepath.Join(dir, "bin", "app")
+	copyExecutable(t, exe, app, nil)
+
+	// launched by a relative path, then the process changes its working
+	// directory, see runWatcher.
+	report := filepath.Join(t.TempDir(), "report")
+	cmd := exec.Command("./bin/app")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		envTestHelper+"=watcher",
+		envTestReport+"="+report,
+		envTestDir+"="+t.TempDir(),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	waitFile(t, report+".watching")
+
+	// deploy a new executable file.
+	copyExecutable(t, exe, app+".new", []byte("v2"))
+	if err := os.Rename(app+".new", app); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFile(t, report+".restarted")
+}
+
+// watchTestExecutable watches the fake executable file "app" like ListenSignal,
+// the restarts are simulated by "start", which reports to the returned channel.
+// the test must wait for the successful restart by waitRestarted.
+func watchTestExecutable(t *testing.T, app string, start func() error) (*Manager, <-chan struct{}) {
+
+	started := make(chan struct{}, 10)
+	testhook.SetStart(func() (*os.Process, error) {
+		started <- struct{}{}
+		if err := start(); err != nil {
+			return nil, err
+		}
+		return &os.Process{Pid: 1<<31 - 1}, nil
+	})
+	testhook.SetExit(func(int) {})
+	SetExecPathResolver(func() (string, error) {
+		return app, nil
+	})
+	SetWatchDelay(50 * time.Millisecond)
+	MinRestartInterval(0)
+	t.Cleanup(func() {
+		testhook.SetStart(nil)
+		testhook.SetExit(nil)
+		SetExecPathResolver(defaultExecPath)
+		SetWatchDelay(time.Second)
+		MinRestartInterval(5 * time.Second)
+		resetRestartState()
+	})
+
+	m := newTestManager(t)
+	if err := watchExecutable(m); err != nil {
+		t.Fatal(err)
+	}
+	return m, started
+}
+
+// waitRestarted waits until the manager stopped by the restart.
+func waitRestarted(t *testing.T, m *Manager) {
+
+	select {
+	case <-m.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the restart doesn't stop the manager")
+	}
+}
+
+// replaceFile renames a new file with "data" over "name", like a deploy.
+func replaceFile(t *testing.T, name string, data []byte) {
+
+	if err := ioutil.WriteFile(name+".new", data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(name+".new", name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchReplacedExecutable(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("an open file can't be replaced on windows")
+	}
+
+	app := filepath.Join(t.TempDir(), "app")
+	if err := ioutil.WriteFile(app, []byte("v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// a running executable file is open, the rename over it only changes its
+	// link count.
+	f, err := os.Open(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m, started := watchTestExecutable(t, app, func() error { return nil })
+
+	// the same content, no restart, but the new file is watched from now on.
+	replaceFile(t, app, []byte("v1"))
+	select {
+	case <-started:
+		t.Fatal("restarted by an unchanged executable file")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	replaceFile(t, app, []byte("v2"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second replacement is not watched")
+	}
+	waitRestarted(t, m)
+}
+
+func TestWatchRetriesFailedRestart(t *testing.T) {
+
+	app := filepath.Join(t.TempDir(), "app")
+	if err := ioutil.WriteFile(app, []byte("v1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var starts int32
+	m, started := watchTestExecutable(t, app, func() error {
+		if atomic.AddInt32(&starts, 1) == 1 {
+			return errors.New("start failed")
+		}
+		return nil
+	})
+
+	if err := ioutil.WriteFile(app, []byte("v2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the change is not forgotten by the failed restart.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d restarts, want 2", i)
+		}
+	}
+	waitRestarted(t, m)
+}